@@ -1,10 +1,10 @@
 package main
 
 import (
-	"log"
-	"net/http"
-	"net/url"
-	"sync"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/W-Floyd/qbittorrent-multiplexer/multiplexer"
 	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
@@ -13,57 +13,143 @@ import (
 type Config struct {
 	Multiplexer multiplexer.Config
 	QBittorrent qbittorrent.Configs
+	Pools       PoolConfigs
+	Server      ServerConfig
 }
 
-func (c Config) Validate() (errs []error) {
+// Unset pool fields fall back to the top level multiplexer config
+type PoolConfig struct {
+	Name      string             `usage:"Name of pool"`
+	Hostname  string             `usage:"Serve this pool for requests with this Host header"`
+	Address   string             `usage:"Listening address for this pool"`
+	Port      uint               `usage:"Listening port for this pool"`
+	Listen    []string           `usage:"Addresses to listen on for this pool (host:port, [::]:port, unix:///path/to/socket)"`
+	Placement string             `usage:"Placement strategy for new torrents (leastbusy, roundrobin)"`
+	Routes    multiplexer.Routes `usage:"Routing table entries, added on top of the multiplexer routes"`
+	Format    struct {
+		Info struct {
+			RemoveFields []string `usage:"Fields to remove from responses (for client performance)"`
+		}
+	}
+	QBittorrent qbittorrent.Configs
+}
 
-	g := sync.WaitGroup{}
+type PoolConfigs []*PoolConfig
 
-	errsChan := make(chan error)
+type Pool struct {
+	*multiplexer.Multiplexer
+	Listen   []string
+	Hostname string
+}
 
-	g.Add(2)
-	go func() {
-		defer g.Done()
-		for _, err := range c.Multiplexer.Validate() {
-			errsChan <- err
-		}
-	}()
-	go func() {
-		defer g.Done()
-		for _, err := range c.QBittorrent.Validate() {
-			errsChan <- err
+// PoolConfigs returns the configured pools, or a single pool made of the top level instances
+func (c Config) PoolConfigs() PoolConfigs {
+	if len(c.Pools) == 0 {
+		return PoolConfigs{
+			{
+				Name:        "default",
+				QBittorrent: c.QBittorrent,
+			},
 		}
-	}()
+	}
+	return c.Pools
+}
 
-	go func() {
-		g.Wait()
-		close(errsChan)
-	}()
+func (c Config) New() (pools []*Pool, errs []error) {
 
-	for err := range errsChan {
-		errs = append(errs, err)
+	if len(c.Pools) != 0 && len(c.QBittorrent) != 0 {
+		errs = append(errs, errors.New("(Config) Use either QBittorrent or Pools, not both"))
 	}
 
-	return errs
-}
+	errs = append(errs, c.Server.Validate()...)
 
-func (c Config) Prime() (errs []error) {
+	names := map[string]bool{}
+	hosts := map[string]map[string]bool{}
 
-	r := &http.Request{
-		URL: &url.URL{
-			Path: "/api/v2/torrents/info",
-		},
-	}
+	for _, p := range c.PoolConfigs() {
+
+		config := c.Multiplexer
+		if p.Address != "" {
+			config.Address = p.Address
+		}
+		if p.Port != 0 {
+			config.Port = p.Port
+		}
+		if p.Placement != "" {
+			config.Placement = p.Placement
+		}
+		if p.Routes != nil {
+			config.Routes = config.Routes.Merge(p.Routes)
+		}
+		if p.Format.Info.RemoveFields != nil {
+			config.Format.Info.RemoveFields = p.Format.Info.RemoveFields
+		}
+
+		if p.Name == "" {
+			errs = append(errs, errors.New("(Pool) Empty Name"))
+		} else if names[p.Name] {
+			errs = append(errs, errors.New("(Pool) Duplicate Name: "+p.Name))
+		}
+		names[p.Name] = true
+
+		// The most specific setting wins: the pool's listeners, then its own
+		// address and port, then the server's listeners
+		listen := c.Server.Listen
+		if p.Listen != nil {
+			listen = p.Listen
+			for _, l := range listen {
+				errs = append(errs, validateListen(l)...)
+			}
+		} else if p.Address != "" || p.Port != 0 {
+			listen = nil
+		}
+		if len(listen) == 0 {
+			listen = []string{net.JoinHostPort(config.Address, strconv.FormatUint(uint64(config.Port), 10))}
+		}
+
+		hostname := strings.ToLower(p.Hostname)
+		for _, l := range listen {
+			if hosts[l] == nil {
+				hosts[l] = map[string]bool{}
+			}
+			if hosts[l][hostname] {
+				errs = append(errs, errors.New("("+p.Name+") Another pool already serves "+l+" for hostname \""+hostname+"\""))
+			}
+			hosts[l][hostname] = true
+		}
+
+		m, poolErrs := multiplexer.New(config, p.QBittorrent)
+		for _, err := range poolErrs {
+			errs = append(errs, errors.New("("+p.Name+") "+err.Error()))
+		}
+		m.Name = p.Name
 
-	resps := c.ParallelResponses(r, RequestOptions{
-		Callback: &RequestCallbackTorrentInfoAdd,
-	})
+		pools = append(pools, &Pool{
+			Multiplexer: m,
+			Listen:      listen,
+			Hostname:    hostname,
+		})
 
-	for _, resp := range resps {
-		errs = append(errs, resp.errs...)
 	}
 
-	log.Println("Torrent list primed")
+	return
 
-	return errs
+}
+
+// Routers groups the pools by listening address
+func Routers(pools []*Pool) map[string]*multiplexer.HostRouter {
+	routers := map[string]*multiplexer.HostRouter{}
+	for _, p := range pools {
+		for _, listen := range p.Listen {
+			if _, ok := routers[listen]; !ok {
+				routers[listen] = multiplexer.NewHostRouter()
+			}
+			if p.Hostname == "" {
+				routers[listen].Default = p.Multiplexer
+			} else {
+				routers[listen].Hosts[p.Hostname] = p.Multiplexer
+			}
+		}
+	}
+	return routers
 }
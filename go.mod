@@ -1,6 +1,6 @@
 module github.com/W-Floyd/qbittorrent-multiplexer
 
-go 1.23.4
+go 1.24
 
 require (
 	github.com/Jeffail/gabs/v2 v2.7.0
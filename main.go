@@ -8,10 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"time"
 
-	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	// _ "github.com/motemen/go-loghttp/global"
@@ -92,15 +89,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Router
-
-	r := mux.NewRouter()
-
-	r.PathPrefix("/").HandlerFunc(conf.HandleAll)
-
-	// r.Use(zapchi.Logger(logger, "router"))
-
-	errs := conf.Validate()
+	pools, errs := conf.New()
 	if errs != nil {
 		fmt.Println("Errors in config:")
 		for _, err := range errs {
@@ -109,24 +98,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	errs = conf.Prime()
-	if errs != nil {
-		log.Println(errs)
+	for _, p := range pools {
+		errs = p.Prime()
+		if errs != nil {
+			log.Println(errs)
+		}
 	}
 
-	srv := &http.Server{
-		Addr:         conf.Multiplexer.Address + ":" + strconv.FormatUint(uint64(conf.Multiplexer.Port), 10),
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      r,
-	}
+	servers := []*http.Server{}
+
+	for listen, router := range Routers(pools) {
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		// r.Use(zapchi.Logger(logger, "router"))
+
+		srv, err := conf.Server.NewServer(listen, router)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-	}()
+
+		go func() {
+			if err := Serve(srv); err != nil && err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}()
+
+		servers = append(servers, srv)
+
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -135,7 +134,12 @@ func main() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), conf.Multiplexer.ShutdownTimeout)
 	defer cancel()
-	srv.Shutdown(ctx)
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
+	for _, p := range pools {
+		p.Close()
+	}
 	log.Println("shutting down")
 
 	// err = ShutdownDB()
@@ -0,0 +1,243 @@
+package multiplexer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// SpeedLimitsModeMixed is reported by speedLimitsMode when instances disagree
+const SpeedLimitsModeMixed = "2"
+
+// A window turns the alternative speed limits on from From until To (15:04),
+// crossing midnight if To is earlier. Days (mon, tue...) limit the days it starts on.
+type AltSpeedWindow struct {
+	From string   `usage:"Start time (15:04)"`
+	To   string   `usage:"End time (15:04)"`
+	Days []string `usage:"Days the window starts on (mon, tue...), every day if empty"`
+}
+
+type AltSpeedConfig struct {
+	Schedule []AltSpeedWindow `usage:"Times the alternative speed limits are on for the whole pool, off outside them"`
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (c AltSpeedConfig) Validate() (errs []error) {
+	for _, window := range c.Schedule {
+		for _, t := range []string{window.From, window.To} {
+			if _, err := time.Parse("15:04", t); err != nil {
+				errs = append(errs, errors.New("(AltSpeed) Bad time: "+t))
+			}
+		}
+		for _, day := range window.Days {
+			if !slices.Contains(weekdays, strings.ToLower(day)) {
+				errs = append(errs, errors.New("(AltSpeed) Unknown day: "+day))
+			}
+		}
+	}
+	return
+}
+
+// Active reports whether now falls in any window of the schedule
+func (c AltSpeedConfig) Active(now time.Time) bool {
+
+	minutes := now.Hour()*60 + now.Minute()
+	today := weekdays[now.Weekday()]
+	yesterday := weekdays[(now.Weekday()+6)%7]
+
+	for _, window := range c.Schedule {
+		from, err := time.Parse("15:04", window.From)
+		if err != nil {
+			continue
+		}
+		to, err := time.Parse("15:04", window.To)
+		if err != nil {
+			continue
+		}
+		start := from.Hour()*60 + from.Minute()
+		end := to.Hour()*60 + to.Minute()
+
+		startsOn := func(day string) bool {
+			if len(window.Days) == 0 {
+				return true
+			}
+			return slices.ContainsFunc(window.Days, func(d string) bool { return strings.ToLower(d) == day })
+		}
+
+		if start <= end {
+			if minutes >= start && minutes < end && startsOn(today) {
+				return true
+			}
+		} else {
+			// Crosses midnight, the tail belongs to the window that started yesterday
+			if minutes >= start && startsOn(today) {
+				return true
+			}
+			if minutes < end && startsOn(yesterday) {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+// keepScheduling applies the schedule whenever it moves in or out of a window,
+// so manual changes stick until the next one
+func (m *Multiplexer) keepScheduling() {
+
+	var last *bool
+
+	for {
+		now := time.Now()
+		active := m.Config.AltSpeed.Active(now)
+		if last == nil || *last != active {
+			last = &active
+			log.Println("Alternative speed limits scheduled " + onOff(active) + " (" + m.Name + ")")
+			if err := m.SetSpeedLimitsMode(active); err != nil {
+				log.Println("Scheduling alternative speed limits (" + m.Name + "): " + err.Error())
+				// Try again next time around
+				last = nil
+			}
+		}
+		if !m.wait(time.Until(now.Truncate(time.Minute).Add(time.Minute))) {
+			return
+		}
+	}
+
+}
+
+// SpeedLimitsModes returns the alternative speed limit state of every ready instance
+func (m *Multiplexer) SpeedLimitsModes() (map[*qbittorrent.Instance]bool, error) {
+
+	instances := m.Pool.Ready()
+	if len(instances) == 0 {
+		return nil, errors.New("no instance available")
+	}
+
+	modes := make([]bool, len(instances))
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) (err error) {
+		modes[n], err = instance.SpeedLimitsMode()
+		return
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	result := map[*qbittorrent.Instance]bool{}
+	for n, instance := range instances {
+		result[instance] = modes[n]
+	}
+	return result, nil
+
+}
+
+// SetSpeedLimitsMode moves every ready instance to the same state
+func (m *Multiplexer) SetSpeedLimitsMode(enabled bool) error {
+	m.Locks.AltSpeed.Lock()
+	defer m.Locks.AltSpeed.Unlock()
+	return m.setSpeedLimitsMode(enabled)
+}
+
+// ToggleSpeedLimitsMode turns the limits on everywhere unless any instance
+// has them on already, then off everywhere. It returns the new state.
+func (m *Multiplexer) ToggleSpeedLimitsMode() (bool, error) {
+
+	// Held from reading to setting, so concurrent toggles take turns
+	m.Locks.AltSpeed.Lock()
+	defer m.Locks.AltSpeed.Unlock()
+
+	modes, err := m.SpeedLimitsModes()
+	if err != nil {
+		return false, err
+	}
+	enabled := !slices.Contains(slices.Collect(maps.Values(modes)), true)
+
+	return enabled, m.setSpeedLimitsMode(enabled)
+
+}
+
+// setSpeedLimitsMode needs Locks.AltSpeed to be held
+func (m *Multiplexer) setSpeedLimitsMode(enabled bool) error {
+
+	errs := ParallelCalls(m.Pool.Ready(), func(n int, instance *qbittorrent.Instance) error {
+		return instance.SetSpeedLimitsMode(enabled)
+	})
+
+	return errors.Join(errs...)
+
+}
+
+// HandlerSpeedLimitsMode answers the transfer/*SpeedLimitsMode endpoints for
+// the whole pool. Toggling from a mixed state turns the limits off everywhere.
+func (m *Multiplexer) HandlerSpeedLimitsMode(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/transfer/")
+
+	switch path {
+	case "speedLimitsMode":
+		modes, err := m.SpeedLimitsModes()
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		on, off := 0, 0
+		for _, mode := range modes {
+			if mode {
+				on += 1
+			} else {
+				off += 1
+			}
+		}
+		body := "0"
+		if on != 0 && off != 0 {
+			body = SpeedLimitsModeMixed
+		} else if on != 0 {
+			body = "1"
+		}
+		m.MakeResponse(nil, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Request: r}, w)
+
+	case "toggleSpeedLimitsMode", "setSpeedLimitsMode":
+		var enabled bool
+		var err error
+		if path == "setSpeedLimitsMode" {
+			mode, convErr := strconv.Atoi(r.Form.Get("mode"))
+			if convErr != nil || (mode != 0 && mode != 1) {
+				http.Error(w, "bad mode: "+r.Form.Get("mode"), http.StatusBadRequest)
+				return
+			}
+			enabled = mode == 1
+			err = m.SetSpeedLimitsMode(enabled)
+		} else {
+			enabled, err = m.ToggleSpeedLimitsMode()
+		}
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		log.Println("Alternative speed limits " + onOff(enabled) + " (" + m.Name + ")")
+		m.MakeResponse(nil, &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, w)
+
+	default:
+		http.Error(w, "unknown speed limits endpoint: "+r.URL.Path, http.StatusNotFound)
+	}
+
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
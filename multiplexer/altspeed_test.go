@@ -0,0 +1,127 @@
+package multiplexer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAltSpeedActive(t *testing.T) {
+
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+
+	office := AltSpeedWindow{From: "09:00", To: "17:00"}
+	night := AltSpeedWindow{From: "22:00", To: "06:00"}
+	weekendNight := AltSpeedWindow{From: "23:00", To: "02:00", Days: []string{"Sat", "sun"}}
+
+	tests := []struct {
+		name     string
+		schedule []AltSpeedWindow
+		now      time.Time
+		want     bool
+	}{
+		{"empty schedule", nil, at(1, "12:00"), false},
+		{"inside", []AltSpeedWindow{office}, at(1, "12:00"), true},
+		{"from is inclusive", []AltSpeedWindow{office}, at(1, "09:00"), true},
+		{"to is exclusive", []AltSpeedWindow{office}, at(1, "17:00"), false},
+		{"before", []AltSpeedWindow{office}, at(1, "08:59"), false},
+		{"midnight crossing, evening", []AltSpeedWindow{night}, at(1, "23:30"), true},
+		{"midnight crossing, after midnight", []AltSpeedWindow{night}, at(2, "05:59"), true},
+		{"midnight crossing, ended", []AltSpeedWindow{night}, at(2, "06:00"), false},
+		{"midnight crossing, daytime", []AltSpeedWindow{night}, at(2, "12:00"), false},
+		{"day filter, starts on saturday", []AltSpeedWindow{weekendNight}, at(6, "23:30"), true},
+		{"day filter, tail on sunday", []AltSpeedWindow{weekendNight}, at(7, "01:00"), true},
+		{"day filter, tail on monday from sunday", []AltSpeedWindow{weekendNight}, at(8, "01:00"), true},
+		{"day filter, friday night", []AltSpeedWindow{weekendNight}, at(5, "23:30"), false},
+		{"day filter, tail on saturday from friday", []AltSpeedWindow{weekendNight}, at(6, "01:00"), false},
+		{"several windows", []AltSpeedWindow{office, night}, at(3, "03:00"), true},
+		{"bad window skipped", []AltSpeedWindow{{From: "25:00", To: "26:00"}, office}, at(1, "10:00"), true},
+	}
+
+	for _, test := range tests {
+		c := AltSpeedConfig{Schedule: test.schedule}
+		if got := c.Active(test.now); got != test.want {
+			t.Errorf("%s: Active(%s) = %v, want %v", test.name, test.now.Format("Mon 15:04"), got, test.want)
+		}
+	}
+
+}
+
+// altSpeedInstance keeps an alternative speed limits state that only toggles,
+// slowly enough for concurrent calls to overlap
+func altSpeedInstance(t *testing.T, mode *atomic.Bool) *httptest.Server {
+	return fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/transfer/speedLimitsMode":
+			time.Sleep(5 * time.Millisecond)
+			if mode.Load() {
+				io.WriteString(w, "1")
+			} else {
+				io.WriteString(w, "0")
+			}
+		case "/api/v2/transfer/toggleSpeedLimitsMode":
+			time.Sleep(5 * time.Millisecond)
+			mode.Store(!mode.Load())
+		default:
+			io.WriteString(w, "[]")
+		}
+	})
+}
+
+func TestSpeedLimitsModeConcurrent(t *testing.T) {
+
+	modes := make([]atomic.Bool, 3)
+	servers := []*httptest.Server{}
+	for n := range modes {
+		servers = append(servers, altSpeedInstance(t, &modes[n]))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+
+	send := func(target string) {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d %q", target, w.Code, w.Body.String())
+		}
+	}
+
+	check := func(want bool) {
+		for n := range modes {
+			if modes[n].Load() != want {
+				t.Errorf("instance %d has the limits %s, want %s", n, onOff(modes[n].Load()), onOff(want))
+			}
+		}
+	}
+
+	run := func(times int, target string) {
+		g := sync.WaitGroup{}
+		for range times {
+			g.Add(1)
+			go func() {
+				defer g.Done()
+				send(target)
+			}()
+		}
+		g.Wait()
+	}
+
+	// Setting the same mode many times at once can't flip it back
+	run(10, "/api/v2/transfer/setSpeedLimitsMode?mode=1")
+	check(true)
+
+	// Toggles take turns, an even number of them changes nothing
+	run(10, "/api/v2/transfer/toggleSpeedLimitsMode")
+	check(true)
+	run(1, "/api/v2/transfer/toggleSpeedLimitsMode")
+	check(false)
+
+}
@@ -0,0 +1,280 @@
+package multiplexer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	SplitEven   = "even"   // Same share for every instance
+	SplitWeight = "weight" // Shares follow the instance weights
+	SplitDemand = "demand" // Shares follow current speeds, with a small floor each
+
+	DefaultBandwidthInterval = 30 * time.Second
+
+	// Part of the limit handed out evenly when splitting by demand, so idle instances can pick up
+	demandFloor = 0.1
+)
+
+type BandwidthConfig struct {
+	Download int64         `usage:"Download limit for the whole pool in bytes/s, split across instances (0 leaves instance limits alone)"`
+	Upload   int64         `usage:"Upload limit for the whole pool in bytes/s, split across instances (0 leaves instance limits alone)"`
+	Split    string        `default:"even" usage:"How pool limits are split (even, weight, demand)"`
+	Interval time.Duration `default:"30s" usage:"How often pool limits are re-balanced"`
+}
+
+func (c BandwidthConfig) Validate() (errs []error) {
+	switch c.Split {
+	case "", SplitEven, SplitWeight, SplitDemand:
+	default:
+		errs = append(errs, errors.New("(Bandwidth) Unknown Split: "+c.Split))
+	}
+	if c.Download < 0 || c.Upload < 0 {
+		errs = append(errs, errors.New("(Bandwidth) Negative limit"))
+	}
+	return
+}
+
+// Limits are the pool wide bandwidth limits in bytes/s, 0 for unlimited. A nil
+// limit isn't managed by the multiplexer, instances keep their own.
+type Limits struct {
+	Download *int64
+	Upload   *int64
+}
+
+// SetLimits replaces the managed limits (nil leaves one as it is) and applies them
+func (m *Multiplexer) SetLimits(download, upload *int64) error {
+
+	m.Locks.Limits.Lock()
+	if download != nil {
+		m.Limits.Download = download
+	}
+	if upload != nil {
+		m.Limits.Upload = upload
+	}
+	m.Locks.Limits.Unlock()
+
+	m.balancer.Do(func() {
+		go m.keepBalancing()
+	})
+
+	return m.Balance()
+
+}
+
+func (m *Multiplexer) limits() Limits {
+	m.Locks.Limits.Lock()
+	defer m.Locks.Limits.Unlock()
+	return m.Limits
+}
+
+func (m *Multiplexer) keepBalancing() {
+	interval := m.Config.Bandwidth.Interval
+	if interval <= 0 {
+		interval = DefaultBandwidthInterval
+	}
+	for m.wait(interval) {
+		if err := m.Balance(); err != nil {
+			log.Println("Bandwidth balancing (" + m.Name + "): " + err.Error())
+		}
+	}
+}
+
+// Balance splits the managed limits across the ready instances
+func (m *Multiplexer) Balance() error {
+
+	limits := m.limits()
+	if limits.Download == nil && limits.Upload == nil {
+		return nil
+	}
+
+	instances := m.Pool.Ready()
+	if len(instances) == 0 {
+		return nil
+	}
+
+	var info []*qbittorrent.TransferInfo
+	if m.Config.Bandwidth.Split == SplitDemand {
+		info = make([]*qbittorrent.TransferInfo, len(instances))
+		// Instances that don't answer count as idle, they only get their part of the floor
+		ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) (err error) {
+			info[n], err = instance.TransferInfo()
+			return
+		})
+	}
+
+	errs := []error{}
+
+	if limits.Download != nil {
+		shares := m.shares(*limits.Download, instances, info, func(t *qbittorrent.TransferInfo) int64 { return t.DlInfoSpeed })
+		errs = append(errs, ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+			return instance.SetDownloadLimit(shares[n])
+		})...)
+	}
+
+	if limits.Upload != nil {
+		shares := m.shares(*limits.Upload, instances, info, func(t *qbittorrent.TransferInfo) int64 { return t.UpInfoSpeed })
+		errs = append(errs, ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+			return instance.SetUploadLimit(shares[n])
+		})...)
+	}
+
+	return errors.Join(errs...)
+
+}
+
+// shares splits limit between the instances, info is only used to split by demand
+func (m *Multiplexer) shares(limit int64, instances []*qbittorrent.Instance, info []*qbittorrent.TransferInfo, speed func(*qbittorrent.TransferInfo) int64) []int64 {
+
+	shares := make([]int64, len(instances))
+	if limit == 0 {
+		return shares
+	}
+
+	weights := make([]float64, len(instances))
+	for n, instance := range instances {
+		weights[n] = 1
+		if m.Config.Bandwidth.Split == SplitWeight {
+			weights[n] = instance.Weight
+		}
+	}
+
+	if m.Config.Bandwidth.Split == SplitDemand {
+		total := 0.0
+		for n := range instances {
+			if info[n] != nil {
+				total += float64(speed(info[n]))
+			}
+		}
+		// With nothing moving the split stays even
+		if total > 0 {
+			for n := range instances {
+				weights[n] = demandFloor / float64(len(instances))
+				if info[n] != nil {
+					weights[n] += (1 - demandFloor) * float64(speed(info[n])) / total
+				}
+			}
+		}
+	}
+
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+
+	for n := range instances {
+		share := float64(limit)
+		if sum > 0 {
+			share = share * weights[n] / sum
+		}
+		// 0 would lift the limit entirely
+		shares[n] = max(int64(math.Floor(share)), 1)
+	}
+
+	return shares
+
+}
+
+// HandlerLimits answers the transfer/*Limit endpoints for the whole pool
+func (m *Multiplexer) HandlerLimits(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/transfer/")
+	limits := m.limits()
+
+	switch path {
+	case "downloadLimit", "uploadLimit":
+		limit := limits.Download
+		if path == "uploadLimit" {
+			limit = limits.Upload
+		}
+		if limit == nil {
+			// Unmanaged, report what the instances add up to
+			value, err := m.poolLimit(path == "uploadLimit")
+			if err != nil {
+				m.MakeResponse(err, nil, w)
+				return
+			}
+			limit = &value
+		}
+		body := strings.NewReader(strconv.FormatInt(*limit, 10))
+		m.MakeResponse(nil, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(body), Request: r}, w)
+
+	case "setDownloadLimit", "setUploadLimit":
+		limit, err := strconv.ParseInt(r.Form.Get("limit"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad limit: "+r.Form.Get("limit"), http.StatusBadRequest)
+			return
+		}
+		// qBittorrent takes anything below 1 as unlimited
+		limit = max(limit, 0)
+		if path == "setDownloadLimit" {
+			err = m.SetLimits(&limit, nil)
+		} else {
+			err = m.SetLimits(nil, &limit)
+		}
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		m.MakeResponse(nil, &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, w)
+
+	default:
+		http.Error(w, "unknown limit endpoint: "+r.URL.Path, http.StatusNotFound)
+	}
+
+}
+
+// poolLimit adds up the instances' own limits, unlimited if any of them is
+func (m *Multiplexer) poolLimit(upload bool) (int64, error) {
+
+	instances := m.Pool.Ready()
+	if len(instances) == 0 {
+		return 0, errors.New("no instance available")
+	}
+
+	limits := make([]int64, len(instances))
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		info, err := instance.TransferInfo()
+		if err != nil {
+			return err
+		}
+		limits[n] = info.DlRateLimit
+		if upload {
+			limits[n] = info.UpRateLimit
+		}
+		return nil
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, limit := range limits {
+		if limit <= 0 {
+			return 0, nil
+		}
+		total += limit
+	}
+	return total, nil
+
+}
+
+// overrideLimits reports managed limits in place of the instances' own
+func (m *Multiplexer) overrideLimits(statistics map[string]interface{}) {
+	limits := m.limits()
+	if limits.Download != nil {
+		statistics["dl_rate_limit"] = float64(*limits.Download)
+	}
+	if limits.Upload != nil {
+		statistics["up_rate_limit"] = float64(*limits.Upload)
+	}
+}
@@ -0,0 +1,114 @@
+package multiplexer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+func TestShares(t *testing.T) {
+
+	speeds := func(speeds ...int64) (info []*qbittorrent.TransferInfo) {
+		for _, speed := range speeds {
+			if speed < 0 {
+				info = append(info, nil) // Didn't answer
+			} else {
+				info = append(info, &qbittorrent.TransferInfo{DlInfoSpeed: speed})
+			}
+		}
+		return
+	}
+
+	tests := []struct {
+		name    string
+		split   string
+		limit   int64
+		weights []float64
+		info    []*qbittorrent.TransferInfo
+		want    []int64
+	}{
+		{"even", SplitEven, 1000, []float64{1, 1, 1}, nil, []int64{333, 333, 333}},
+		{"unlimited", SplitEven, 0, []float64{1, 1}, nil, []int64{0, 0}},
+		{"never below 1", SplitEven, 2, []float64{1, 1, 1}, nil, []int64{1, 1, 1}},
+		{"weights", SplitWeight, 1000, []float64{1, 3}, nil, []int64{250, 750}},
+		{"weights ignored when even", SplitEven, 1000, []float64{1, 3}, nil, []int64{500, 500}},
+		{"demand", SplitDemand, 1000, []float64{1, 1}, speeds(300, 100), []int64{725, 275}},
+		{"demand idle instance gets the floor", SplitDemand, 1000, []float64{1, 1}, speeds(500, 0), []int64{950, 50}},
+		{"demand silent instance gets the floor", SplitDemand, 1000, []float64{1, 1}, speeds(500, -1), []int64{950, 50}},
+		{"demand nothing moving", SplitDemand, 1000, []float64{1, 1}, speeds(0, 0), []int64{500, 500}},
+		{"demand nobody answering", SplitDemand, 1000, []float64{1, 1}, speeds(-1, -1), []int64{500, 500}},
+	}
+
+	for _, test := range tests {
+		m := &Multiplexer{Config: Config{Bandwidth: BandwidthConfig{Split: test.split}}}
+		instances := []*qbittorrent.Instance{}
+		for _, weight := range test.weights {
+			instances = append(instances, &qbittorrent.Instance{Weight: weight})
+		}
+		got := m.shares(test.limit, instances, test.info, func(t *qbittorrent.TransferInfo) int64 { return t.DlInfoSpeed })
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+}
+
+func TestHandlerLimits(t *testing.T) {
+
+	mutex := sync.Mutex{}
+	set := make([][]string, 2)
+
+	servers := []*httptest.Server{}
+	for n := range set {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/transfer/setDownloadLimit":
+				mutex.Lock()
+				set[n] = append(set[n], r.FormValue("limit"))
+				mutex.Unlock()
+			case "/api/v2/transfer/info":
+				io.WriteString(w, `{"dl_rate_limit":300,"up_rate_limit":0}`)
+			default:
+				io.WriteString(w, "[]")
+			}
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+
+	send := func(method, target string, form url.Values) string {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// Unmanaged, the instances' own limits add up
+	if got := send(http.MethodGet, "/api/v2/transfer/downloadLimit", nil); got != "600" {
+		t.Errorf("unmanaged download limit is %q, want 600", got)
+	}
+	if got := send(http.MethodGet, "/api/v2/transfer/uploadLimit", nil); got != "0" {
+		t.Errorf("unmanaged upload limit is %q, want unlimited", got)
+	}
+
+	send(http.MethodPost, "/api/v2/transfer/setDownloadLimit", url.Values{"limit": {"1000"}})
+	if got := send(http.MethodGet, "/api/v2/transfer/downloadLimit", nil); got != "1000" {
+		t.Errorf("managed download limit is %q, want 1000", got)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for n := range set {
+		if len(set[n]) == 0 || set[n][0] != "500" {
+			t.Errorf("instance %d was set to %v, want 500", n, set[n])
+		}
+	}
+
+}
@@ -0,0 +1,344 @@
+package multiplexer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	DefaultBannedIPsInterval = 5 * time.Minute
+	PreferenceBannedIPs      = "banned_IPs"
+)
+
+type BannedIPsConfig struct {
+	IPs       []string      `usage:"IPs kept banned on every instance"`
+	File      string        `usage:"File of IPs kept banned on every instance, one per line, read again on every check"`
+	Exclusive bool          `usage:"Also lift bans on the instances that aren't on the list"`
+	Interval  time.Duration `default:"5m" usage:"How often the instances are checked"`
+}
+
+func (c BannedIPsConfig) Enabled() bool {
+	return len(c.IPs) != 0 || c.File != ""
+}
+
+func (c BannedIPsConfig) Validate() (errs []error) {
+	for _, ip := range c.IPs {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, errors.New("(BannedIPs) Bad IP: "+ip))
+		}
+	}
+	if c.File != "" {
+		if _, err := os.Stat(c.File); err != nil {
+			errs = append(errs, errors.New("(BannedIPs) "+err.Error()))
+		}
+	}
+	return
+}
+
+// Drift is how far an instance's own list was from the managed one when last checked
+type Drift struct {
+	Missing []string
+	Extra   []string
+	Checked time.Time
+	Err     error
+}
+
+func (d Drift) String() string {
+	if d.Err != nil {
+		return "error - " + d.Err.Error()
+	}
+	return strconv.Itoa(len(d.Missing)) + " missing, " + strconv.Itoa(len(d.Extra)) + " extra - checked " + d.Checked.Format(time.RFC3339)
+}
+
+// BannedIPs holds what the managed blocklist picked up while running
+type BannedIPs struct {
+	Added []string // Banned through the multiplexer, sorted
+	Drift map[*qbittorrent.Instance]Drift
+}
+
+// BannedIPList returns the managed blocklist, sorted and without duplicates
+func (m *Multiplexer) BannedIPList() ([]string, error) {
+
+	ips := slices.Clone(m.Config.BannedIPs.IPs)
+
+	m.Locks.BannedIPs.Lock()
+	ips = append(ips, m.BannedIPs.Added...)
+	m.Locks.BannedIPs.Unlock()
+
+	if m.Config.BannedIPs.File != "" {
+		file, err := os.ReadFile(m.Config.BannedIPs.File)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, splitIPs(string(file))...)
+	}
+
+	slices.Sort(ips)
+	return slices.Compact(ips), nil
+
+}
+
+// splitIPs reads a newline separated list, skipping blank lines and # comments
+func splitIPs(list string) (ips []string) {
+	for _, line := range strings.Split(list, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			ips = append(ips, line)
+		}
+	}
+	return
+}
+
+func (m *Multiplexer) keepSyncingBannedIPs() {
+	interval := m.Config.BannedIPs.Interval
+	if interval <= 0 {
+		interval = DefaultBannedIPsInterval
+	}
+	for {
+		if err := m.SyncBannedIPs(); err != nil {
+			log.Println("Syncing banned IPs (" + m.Name + "): " + err.Error())
+		}
+		if !m.wait(interval) {
+			return
+		}
+	}
+}
+
+// SyncBannedIPs puts the managed blocklist on every ready instance, recording
+// any drift found. Unless the list is exclusive, bans found on one instance are
+// spread to the others, without joining the list (UnbanIPs lifts them).
+func (m *Multiplexer) SyncBannedIPs() error {
+
+	m.Locks.BanSync.Lock()
+	defer m.Locks.BanSync.Unlock()
+
+	list, err := m.BannedIPList()
+	if err != nil {
+		return err
+	}
+
+	instances := m.Pool.Ready()
+	banned := make([][]string, len(instances))
+	drifts := make([]Drift, len(instances))
+
+	ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		drifts[n].Checked = time.Now()
+		preferences, err := instance.Preferences()
+		if err != nil {
+			drifts[n].Err = err
+			return nil
+		}
+		current, _ := preferences[PreferenceBannedIPs].(string)
+		banned[n] = splitIPs(current)
+		slices.Sort(banned[n])
+		banned[n] = slices.Compact(banned[n])
+		return nil
+	})
+
+	for n := range instances {
+		if drifts[n].Err != nil {
+			continue
+		}
+		for _, ip := range list {
+			if !slices.Contains(banned[n], ip) {
+				drifts[n].Missing = append(drifts[n].Missing, ip)
+			}
+		}
+		for _, ip := range banned[n] {
+			if !slices.Contains(list, ip) {
+				drifts[n].Extra = append(drifts[n].Extra, ip)
+			}
+		}
+	}
+
+	if !m.Config.BannedIPs.Exclusive {
+		extra := []string{}
+		for _, drift := range drifts {
+			extra = append(extra, drift.Extra...)
+		}
+		if len(extra) != 0 {
+			list = append(list, extra...)
+			slices.Sort(list)
+			list = slices.Compact(list)
+		}
+	}
+
+	ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		if drifts[n].Err != nil || slices.Equal(banned[n], list) {
+			return nil
+		}
+		if len(drifts[n].Missing) != 0 || len(drifts[n].Extra) != 0 {
+			log.Println("Banned IPs drifted (" + instance.Host() + "): " + drifts[n].String())
+		}
+		drifts[n].Err = instance.SetPreferences(qbittorrent.Preferences{
+			PreferenceBannedIPs: strings.Join(list, "\n"),
+		})
+		return nil
+	})
+
+	m.Locks.BannedIPs.Lock()
+	defer m.Locks.BannedIPs.Unlock()
+
+	errs := []error{}
+	for n, instance := range instances {
+		m.BannedIPs.Drift[instance] = drifts[n]
+		if drifts[n].Err != nil {
+			errs = append(errs, errors.New("("+instance.Host()+") "+drifts[n].Err.Error()))
+		}
+	}
+
+	return errors.Join(errs...)
+
+}
+
+// HandlerBanPeers bans the peers on every instance, and keeps their IPs on the
+// managed blocklist when there is one. Every peer must be ip:port, a bad one
+// would otherwise be sent to every instance.
+func (m *Multiplexer) HandlerBanPeers(w http.ResponseWriter, r *http.Request) {
+
+	ips := []string{}
+	for _, peer := range strings.Split(r.Form.Get("peers"), "|") {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			http.Error(w, "bad peer: "+peer, http.StatusBadRequest)
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			http.Error(w, "bad peer IP: "+peer, http.StatusBadRequest)
+			return
+		}
+		ips = append(ips, ip.String())
+	}
+
+	if m.Config.BannedIPs.Enabled() {
+		m.Locks.BannedIPs.Lock()
+		m.BannedIPs.Added = append(m.BannedIPs.Added, ips...)
+		slices.Sort(m.BannedIPs.Added)
+		m.BannedIPs.Added = slices.Compact(m.BannedIPs.Added)
+		m.Locks.BannedIPs.Unlock()
+	}
+
+	m.HandlerBroadcast(w, r)
+
+}
+
+// UnbanIPs drops the IPs from the bans made through the multiplexer and from
+// every ready instance at once, so no instance is left to spread them again.
+// IPs from the configured list or file stay banned, they are returned.
+func (m *Multiplexer) UnbanIPs(ips []string) (kept []string, err error) {
+
+	// A sync reading the lists before this would put the IPs back
+	m.Locks.BanSync.Lock()
+	defer m.Locks.BanSync.Unlock()
+
+	configured := slices.Clone(m.Config.BannedIPs.IPs)
+	if m.Config.BannedIPs.File != "" {
+		file, err := os.ReadFile(m.Config.BannedIPs.File)
+		if err != nil {
+			return nil, err
+		}
+		configured = append(configured, splitIPs(string(file))...)
+	}
+
+	lifted := []string{}
+	for _, ip := range ips {
+		if slices.Contains(configured, ip) {
+			kept = append(kept, ip)
+		} else {
+			lifted = append(lifted, ip)
+		}
+	}
+
+	m.Locks.BannedIPs.Lock()
+	m.BannedIPs.Added = slices.DeleteFunc(m.BannedIPs.Added, func(ip string) bool { return slices.Contains(lifted, ip) })
+	m.Locks.BannedIPs.Unlock()
+
+	instances := m.Pool.Ready()
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		preferences, err := instance.Preferences()
+		if err != nil {
+			return err
+		}
+		current, _ := preferences[PreferenceBannedIPs].(string)
+		banned := splitIPs(current)
+		remaining := slices.DeleteFunc(slices.Clone(banned), func(ip string) bool { return slices.Contains(lifted, ip) })
+		if len(remaining) == len(banned) {
+			return nil
+		}
+		return instance.SetPreferences(qbittorrent.Preferences{
+			PreferenceBannedIPs: strings.Join(remaining, "\n"),
+		})
+	})
+	for n, err := range errs {
+		if err != nil {
+			errs[n] = errors.New("(" + instances[n].Host() + ") " + err.Error())
+		}
+	}
+
+	return kept, errors.Join(errs...)
+
+}
+
+// HandlerBannedIPs reports the drift found on each instance, POST checks again
+// first, after lifting the bans on the unban=ip1|ip2 IPs if any
+func (m *Multiplexer) HandlerBannedIPs(w http.ResponseWriter, r *http.Request) {
+
+	if !m.Config.BannedIPs.Enabled() {
+		http.Error(w, "no managed blocklist", http.StatusNotFound)
+		return
+	}
+
+	body := []string{}
+
+	if unban := r.Form.Get("unban"); unban != "" && r.Method == http.MethodPost {
+		kept, err := m.UnbanIPs(strings.Split(unban, "|"))
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		if len(kept) != 0 {
+			log.Println("Not unbanning configured IPs (" + m.Name + "): " + strings.Join(kept, ", "))
+			body = append(body, "still banned by the configured list: "+strings.Join(kept, ", "))
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		// Instances that failed show it in their drift below
+		m.SyncBannedIPs()
+	}
+
+	list, err := m.BannedIPList()
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+
+	body = append([]string{strconv.Itoa(len(list)) + " banned IPs"}, body...)
+
+	m.Locks.BannedIPs.Lock()
+	for _, instance := range m.Pool.All() {
+		line := instance.String() + " - "
+		if drift, ok := m.BannedIPs.Drift[instance]; ok {
+			line += drift.String()
+		} else {
+			line += "not checked yet"
+		}
+		body = append(body, line)
+	}
+	m.Locks.BannedIPs.Unlock()
+
+	m.MakeResponse(nil, &http.Response{Body: io.NopCloser(strings.NewReader(strings.Join(body, "\n")))}, w)
+
+}
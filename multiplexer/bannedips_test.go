@@ -0,0 +1,151 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bannedIPsInstance keeps banned_IPs and records the peers it was asked to ban
+type bannedIPsInstance struct {
+	mutex  sync.Mutex
+	banned string
+	peers  []string
+}
+
+func (b *bannedIPsInstance) server(t *testing.T) *httptest.Server {
+	return fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		switch r.URL.Path {
+		case "/api/v2/app/preferences":
+			json.NewEncoder(w).Encode(map[string]interface{}{PreferenceBannedIPs: b.banned})
+		case "/api/v2/app/setPreferences":
+			preferences := map[string]interface{}{}
+			json.Unmarshal([]byte(r.FormValue("json")), &preferences)
+			b.banned, _ = preferences[PreferenceBannedIPs].(string)
+		case "/api/v2/transfer/banPeers":
+			b.peers = append(b.peers, r.FormValue("peers"))
+		default:
+			io.WriteString(w, "[]")
+		}
+	})
+}
+
+func (b *bannedIPsInstance) list() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return splitIPs(b.banned)
+}
+
+func TestHandlerBanPeers(t *testing.T) {
+
+	instances := []*bannedIPsInstance{{}, {}}
+	m := newTestMultiplexer(t, Config{BannedIPs: BannedIPsConfig{IPs: []string{"10.0.0.1"}}},
+		instances[0].server(t), instances[1].server(t))
+
+	tests := []struct {
+		peers  string
+		status int
+	}{
+		{"1.2.3.4:6881|[2001:db8::1]:51413", http.StatusOK},
+		{"1.2.3.4:6881", http.StatusOK}, // Already on the list
+		{"", http.StatusBadRequest},
+		{"1.2.3.4", http.StatusBadRequest},
+		{"peer.example.com:6881", http.StatusBadRequest},
+		{"5.6.7.8:6881|999.1.1.1:6881", http.StatusBadRequest}, // One bad peer refuses them all
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v2/transfer/banPeers?peers="+test.peers, nil))
+		if w.Code != test.status {
+			t.Errorf("%q: got %d %q, want %d", test.peers, w.Code, w.Body.String(), test.status)
+		}
+	}
+
+	for n, instance := range instances {
+		instance.mutex.Lock()
+		if len(instance.peers) != 2 {
+			t.Errorf("instance %d was asked to ban %q, want only the good requests", n, instance.peers)
+		}
+		instance.mutex.Unlock()
+	}
+
+	m.Locks.BannedIPs.Lock()
+	added := slices.Clone(m.BannedIPs.Added)
+	m.Locks.BannedIPs.Unlock()
+	if want := []string{"1.2.3.4", "2001:db8::1"}; !slices.Equal(added, want) {
+		t.Errorf("blocklist picked up %v, want %v", added, want)
+	}
+
+}
+
+func TestSyncBannedIPs(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		exclusive bool
+		banned    []string // Each instance's own list
+		want      []string
+	}{
+		{"spread", false, []string{"10.0.0.2\n10.0.0.2", ""}, []string{"10.0.0.1", "10.0.0.2"}},
+		{"exclusive", true, []string{"10.0.0.2", "10.0.0.1\n10.0.0.3"}, []string{"10.0.0.1"}},
+	}
+
+	for _, test := range tests {
+		instances := []*bannedIPsInstance{{banned: test.banned[0]}, {banned: test.banned[1]}}
+		m := newTestMultiplexer(t, Config{BannedIPs: BannedIPsConfig{IPs: []string{"10.0.0.1"}, Exclusive: test.exclusive}},
+			instances[0].server(t), instances[1].server(t))
+
+		if err := m.SyncBannedIPs(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		for n, instance := range instances {
+			if got := instance.list(); !slices.Equal(got, test.want) {
+				t.Errorf("%s: instance %d bans %v, want %v", test.name, n, got, test.want)
+			}
+		}
+	}
+
+}
+
+func TestUnbanIPs(t *testing.T) {
+
+	instances := []*bannedIPsInstance{{banned: "10.0.0.1\n10.0.0.2"}, {banned: "10.0.0.2\n10.0.0.3"}}
+	m := newTestMultiplexer(t, Config{BannedIPs: BannedIPsConfig{IPs: []string{"10.0.0.1"}}},
+		instances[0].server(t), instances[1].server(t))
+
+	unban := func(confirm bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/debug/bannedips?unban=10.0.0.1|10.0.0.2", nil)
+		if confirm {
+			r.Header.Set(HeaderConfirm, "true")
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := unban(false); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("unconfirmed unban got %d, want %d", w.Code, http.StatusPreconditionRequired)
+	}
+
+	w := unban(true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "still banned by the configured list: 10.0.0.1") {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+
+	// The sync after it spreads what's left, without bringing 10.0.0.2 back
+	want := []string{"10.0.0.1", "10.0.0.3"}
+	for n, instance := range instances {
+		if got := instance.list(); !slices.Equal(got, want) {
+			t.Errorf("instance %d bans %v, want %v", n, got, want)
+		}
+	}
+
+}
@@ -0,0 +1,682 @@
+package multiplexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+	"github.com/W-Floyd/qbittorrent-multiplexer/util"
+)
+
+type MergeOptions struct {
+	CollisionFn       *func(dest, source interface{}) interface{}
+	EntryTransformer  *func(m *Multiplexer, entry *gabs.Container) *gabs.Container
+	OutputTransformer *func(m *Multiplexer, cont *gabs.Container) *gabs.Container
+	RootIsArray       bool
+	ArrayUnique       bool
+	ArraySortFn       *func(a, b *gabs.Container) int
+}
+
+type RequestOptions struct {
+	Prepare  *func(m *Multiplexer, i *qbittorrent.Instance, r *http.Request) *http.Request // Returns the request for an instance, nil to skip it
+	Filter   *func(m *Multiplexer, r *http.Request) bool                                   // Returns true if request should be made
+	Callback *func(m *Multiplexer, resp *http.Response) error                              // Is called on each response
+}
+
+const (
+	PathPrefixInstance = "/instance/"
+	HeaderInstance     = "X-Multiplexer-Instance"
+)
+
+type Response struct {
+	response *http.Response
+	instance *qbittorrent.Instance
+	errs     []error
+}
+
+var (
+	CollisionReplace = func(dest, source interface{}) interface{} {
+		destArr, destIsArray := dest.([]interface{})
+		sourceArr, sourceIsArray := source.([]interface{})
+		if destIsArray {
+			if sourceIsArray {
+				return append(destArr, sourceArr...)
+			}
+			return append(destArr, source)
+		}
+		if sourceIsArray {
+			return append(append([]interface{}{}, dest), sourceArr...)
+		}
+		return source
+	}
+	RequestCallbackTryAllCacheHash = func(m *Multiplexer, resp *http.Response) (err error) {
+		if resp.Request.Form.Has("hash") {
+			if resp.StatusCode == http.StatusOK {
+				hash := qbittorrent.Hash(resp.Request.Form.Get("hash"))
+				if hash == "" {
+					return errors.New("empty hash when inspecting form")
+				}
+				instance := resp.Request.Context().Value(qbittorrent.ContextKeyInstance).(*qbittorrent.Instance)
+				if instance == nil {
+					return errors.New("empty instance when inspecting context")
+				}
+				if torrentInstance, ok := m.Pool.Owner(hash); ok {
+					if instance != torrentInstance {
+						log.Println("Updating hash to point to ", instance.Host())
+					} else {
+						return nil
+					}
+				}
+				m.Pool.SetTorrent(hash, instance)
+				return nil
+			}
+		}
+		return errors.New("no hash field in form")
+	}
+	RequestFilterOnHash = func(m *Multiplexer, r *http.Request) bool {
+		if r.Form.Has("hash") {
+			hash := qbittorrent.Hash(r.Form.Get("hash"))
+			if hash == "" {
+				return true
+			}
+			if instance, ok := m.Pool.Owner(hash); ok {
+				requestInstance := r.Context().Value(qbittorrent.ContextKeyInstance).(*qbittorrent.Instance)
+				return instance == requestInstance
+			}
+		}
+		return true
+	}
+)
+
+func (m *Multiplexer) HandleAll(w http.ResponseWriter, r *http.Request) {
+
+	err := util.BufferBody(r)
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+	r.ParseForm()
+	r.Body, _ = r.GetBody()
+
+	route := m.Routes.Match(r.URL.Path)
+
+	if !m.runPreRoute(w, r, route) {
+		return
+	}
+
+	redirect, ok := m.checkPolicy(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Path == "/debug/leastbusy" {
+		i := m.Pool.LeastBusy()
+		if i == nil {
+			http.Error(w, "no instance available", http.StatusServiceUnavailable)
+			return
+		}
+		body := strings.NewReader(i.Host())
+		m.MakeResponse(nil, &http.Response{Body: io.NopCloser(body)}, w)
+	} else if r.URL.Path == "/debug/drain" {
+		m.HandlerDrain(w, r)
+	} else if r.URL.Path == "/debug/bannedips" {
+		m.HandlerBannedIPs(w, r)
+	} else if r.URL.Path == "/debug/profiles" {
+		m.HandlerProfiles(w, r)
+	} else if r.URL.Path == "/debug/expirelogins" {
+		for _, instance := range m.Pool.All() {
+			instance.ExpireLogin()
+		}
+		m.MakeResponse(nil, &http.Response{Body: io.NopCloser(strings.NewReader("Marked all cookies to expire"))}, w)
+	} else if r.URL.Path == "/debug/torrents/perinstance" {
+		body := []string{}
+
+		for instance, count := range m.Pool.Counts() {
+			line := instance.String() + " - " + strconv.Itoa(count)
+			if !instance.Ready() {
+				line += " (pending)"
+			}
+			if instance.Draining() {
+				line += " (draining)"
+			}
+			body = append(body, line)
+		}
+
+		m.MakeResponse(nil, &http.Response{Body: io.NopCloser(strings.NewReader(strings.Join(body, "\n")))}, w)
+	} else if strings.HasPrefix(r.URL.Path, PathPrefixInstance) {
+		log.Println("HandlerInstancePrefix")
+		m.HandlerInstancePrefix(w, r)
+	} else if name := r.Header.Get(HeaderInstance); name != "" && !strings.HasPrefix(r.URL.Path, "/api/v2/auth/") {
+		log.Println("HandlerInstance - " + HeaderInstance)
+		i := m.Pool.ByName(name)
+		if i == nil {
+			http.Error(w, "unknown instance: "+name, http.StatusNotFound)
+			return
+		}
+		m.HandlerInstance(w, r, i)
+	} else if redirect != nil {
+		m.HandlerInstance(w, r, redirect)
+	} else {
+		m.HandleRoute(w, r, route)
+	}
+
+}
+
+// HandlerDrain marks the instance=name instance as draining, or not with
+// drain=false, and reports how many torrents it still holds
+func (m *Multiplexer) HandlerDrain(w http.ResponseWriter, r *http.Request) {
+
+	name := r.Form.Get("instance")
+	i := m.Pool.ByName(name)
+	if i == nil {
+		http.Error(w, "unknown instance: "+name, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		drain := true
+		if v := r.Form.Get("drain"); v != "" {
+			var err error
+			drain, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "bad drain value: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		i.SetDraining(drain)
+	}
+
+	state := "active"
+	if i.Draining() {
+		state = "draining"
+	}
+
+	// Asked live, the cached ownership misses torrents deleted since the last sync
+	torrents, err := i.Torrents(nil)
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+	hashes := make([]qbittorrent.Hash, len(torrents))
+	for n, torrent := range torrents {
+		hashes[n] = torrent.Hash
+	}
+	m.Pool.SetTorrents(i, hashes, true)
+
+	body := i.String() + " - " + state + " - " + strconv.Itoa(len(torrents)) + " torrents"
+	m.MakeResponse(nil, &http.Response{Body: io.NopCloser(strings.NewReader(body))}, w)
+
+}
+
+func (m *Multiplexer) HandlerLogin(w http.ResponseWriter, r *http.Request) {
+	resp := http.Response{}
+	resp.StatusCode = http.StatusOK
+	resp.Body = io.NopCloser(strings.NewReader("Ok."))
+	resp.Header = http.Header{}
+	resp.Header.Add("Set-Cookie", "SID=w7UA+CZFdxQZylg0Y6T0Lzx/AQvRHMdV") // Fake it until you make it...
+	m.MakeResponse(nil, &resp, w)
+}
+
+func (m *Multiplexer) HandlerPassthrough(w http.ResponseWriter, r *http.Request) {
+	m.HandlerInstance(w, r, m.Pool.NextRoundRobin())
+}
+
+// Proxies /instance/{name}/... straight to the named instance, WebUI included
+func (m *Multiplexer) HandlerInstancePrefix(w http.ResponseWriter, r *http.Request) {
+
+	name, path, found := strings.Cut(strings.TrimPrefix(r.URL.Path, PathPrefixInstance), "/")
+
+	i := m.Pool.ByName(name)
+	if i == nil {
+		http.Error(w, "unknown instance: "+name, http.StatusNotFound)
+		return
+	}
+
+	// The WebUI uses relative paths, so it must be served from a directory
+	if !found {
+		http.Redirect(w, r, PathPrefixInstance+name+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	newReq := r.Clone(r.Context())
+	newReq.URL.Path = "/" + path
+	newReq.URL.RawPath = ""
+
+	if strings.HasPrefix(newReq.URL.Path, "/api/v2/auth/login") {
+		m.HandlerLogin(w, newReq)
+		return
+	}
+
+	m.HandlerInstance(w, newReq, i)
+}
+
+func (m *Multiplexer) HandlerInstance(w http.ResponseWriter, r *http.Request, i *qbittorrent.Instance) {
+	if i == nil {
+		m.MakeResponse(errors.New("no instance available"), nil, w)
+		return
+	}
+	resp, err := i.Send(i.PrepareRequest(r))
+	m.MakeResponse(err, resp, w)
+}
+
+func (m *Multiplexer) HandlerPlace(w http.ResponseWriter, r *http.Request) {
+	m.HandlerInstance(w, r, m.Place())
+}
+
+func (m *Multiplexer) HandlerTryAll(w http.ResponseWriter, r *http.Request, requestOptions RequestOptions) {
+
+	resps := m.ParallelResponses(r, RequestOptions{
+		Filter: requestOptions.Filter,
+	})
+
+	successCount := 0
+	var resp *http.Response
+	var err error
+
+	for _, r := range resps {
+		if len(r.errs) == 0 && r.response.StatusCode == http.StatusOK {
+			successCount += 1
+			resp = r.response
+		} else if r.response != nil {
+			r.response.Body.Close()
+		}
+	}
+
+	if successCount == 0 {
+		err = errors.New("no successful responses")
+	} else if successCount > 1 {
+		err = errors.New("more than 1 successful response")
+	}
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+
+	err = (*requestOptions.Callback)(m, resp)
+	m.MakeResponse(err, resp, w)
+
+}
+
+// ParallelResponses sends the request to every instance at once. Results are
+// returned in instance order, instances skipped by the filter are left out.
+func (m *Multiplexer) ParallelResponses(r *http.Request, requestOptions RequestOptions) (resps []Response) {
+
+	instances := m.Pool.Ready()
+	results := make([]*Response, len(instances))
+
+	ParallelCalls(instances, func(n int, i *qbittorrent.Instance) error {
+		req := r
+		if requestOptions.Prepare != nil {
+			req = (*requestOptions.Prepare)(m, i, r)
+			if req == nil {
+				return nil
+			}
+		}
+		newReq := i.PrepareRequest(req)
+		if requestOptions.Filter != nil && !(*requestOptions.Filter)(m, newReq) {
+			return nil
+		}
+		resp, err := i.Send(newReq)
+		if errors.Is(err, ErrSkipUpstream) {
+			return nil
+		}
+		result := &Response{instance: i, response: resp}
+		if err != nil {
+			result.errs = append(result.errs, err)
+		}
+		results[n] = result
+		return nil
+	})
+
+	for _, result := range results {
+		if result != nil {
+			resps = append(resps, *result)
+		}
+	}
+
+	if requestOptions.Callback != nil {
+		for n := range resps {
+			if len(resps[n].errs) != 0 {
+				continue
+			}
+			err := (*requestOptions.Callback)(m, resps[n].response)
+			if err != nil {
+				resps[n].errs = append(resps[n].errs, err)
+			}
+		}
+	}
+
+	return
+}
+
+// ParallelCalls runs fn for every instance at once, errors are returned in instance order
+func ParallelCalls(instances []*qbittorrent.Instance, fn func(n int, i *qbittorrent.Instance) error) []error {
+
+	errs := make([]error, len(instances))
+
+	var g sync.WaitGroup
+	for n, i := range instances {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			errs[n] = fn(n, i)
+		}()
+	}
+	g.Wait()
+
+	return errs
+
+}
+
+func (m *Multiplexer) HandlerTorrentsMaindata(r *http.Request) (*http.Response, error) {
+
+	instances := m.Pool.Ready()
+
+	callback := func(m *Multiplexer, resp *http.Response) error {
+
+		if resp.Request == nil {
+			return errors.New("empty request attached to response")
+		}
+
+		instance := resp.Request.Context().Value(qbittorrent.ContextKeyInstance).(*qbittorrent.Instance)
+		if instance == nil {
+			return errors.New("empty instance")
+		}
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+		container, err := gabs.ParseJSON(bodyBytes)
+		if err != nil {
+			return err
+		}
+
+		m.Locks.Statistics.Lock()
+		defer m.Locks.Statistics.Unlock()
+
+		if _, ok := m.Statistics[instance]; !ok {
+			m.Statistics[instance] = map[string]interface{}{}
+		}
+
+		// Partial updates only carry what changed, so the last known values are kept
+		for key, value := range container.Path("server_state").ChildrenMap() {
+			m.Statistics[instance][key] = value.Data()
+		}
+
+		return nil
+
+	}
+
+	resp, err := m.HandlerMergeJSON(r,
+		RequestOptions{
+			Callback: &callback,
+		},
+		MergeOptions{
+			CollisionFn: &CollisionReplace,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyCon, err := gabs.ParseJSONBuffer(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Locks.Statistics.Lock()
+	defer m.Locks.Statistics.Unlock()
+
+	statistics := m.Config.Statistics.Aggregate(instances, m.Statistics)
+	m.overrideLimits(statistics)
+
+	for key, value := range statistics {
+		if _, err = bodyCon.Set(value, "server_state", key); err != nil {
+			return nil, err
+		}
+	}
+
+	newBody := bodyCon.Bytes()
+
+	resp.Body = io.NopCloser(bytes.NewBuffer(newBody))
+	resp.ContentLength = int64(len(newBody))
+	resp.Request = r
+
+	return resp, nil
+
+}
+
+// HandlerTransferInfo combines transfer/info from every instance with the same
+// rules as server_state. With instances=true each instance's own figures are
+// added under "instances", keyed by name.
+func (m *Multiplexer) HandlerTransferInfo(r *http.Request) (*http.Response, error) {
+
+	instances := m.Pool.Ready()
+	values := map[*qbittorrent.Instance]map[string]interface{}{}
+
+	callback := func(m *Multiplexer, resp *http.Response) error {
+
+		if resp.Request == nil {
+			return errors.New("empty request attached to response")
+		}
+
+		instance := resp.Request.Context().Value(qbittorrent.ContextKeyInstance).(*qbittorrent.Instance)
+		if instance == nil {
+			return errors.New("empty instance")
+		}
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+		container, err := gabs.ParseJSON(bodyBytes)
+		if err != nil {
+			return err
+		}
+
+		values[instance] = map[string]interface{}{}
+		for key, value := range container.ChildrenMap() {
+			values[instance][key] = value.Data()
+		}
+
+		return nil
+
+	}
+
+	resp, err := m.HandlerMergeJSON(r,
+		RequestOptions{
+			Callback: &callback,
+		},
+		MergeOptions{
+			CollisionFn: &CollisionReplace,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyCon, err := gabs.ParseJSONBuffer(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	statistics := m.Config.Statistics.Aggregate(instances, values)
+	m.overrideLimits(statistics)
+
+	for key, value := range statistics {
+		if _, err = bodyCon.Set(value, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if breakdown, _ := strconv.ParseBool(r.Form.Get("instances")); breakdown {
+		for _, instance := range instances {
+			if _, ok := values[instance]; !ok {
+				continue
+			}
+			name := instance.Name
+			if name == "" {
+				name = instance.Host()
+			}
+			if _, err = bodyCon.Set(values[instance], "instances", name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	newBody := bodyCon.Bytes()
+
+	resp.Body = io.NopCloser(bytes.NewBuffer(newBody))
+	resp.ContentLength = int64(len(newBody))
+	resp.Request = r
+
+	return resp, nil
+
+}
+
+// func (m *Multiplexer) Handler
+
+func (m *Multiplexer) HandlerMergeJSON(r *http.Request, requestOptions RequestOptions, mergeOptions MergeOptions) (*http.Response, error) {
+
+	if mergeOptions.CollisionFn != nil && mergeOptions.RootIsArray {
+		return nil, errors.New("cannot use RootIsArray and CollisionFn at the same time")
+	}
+
+	if mergeOptions.ArraySortFn != nil && !mergeOptions.RootIsArray {
+		return nil, errors.New("cannot use ArraySortFn when RootIsArray is not true")
+	}
+
+	resps := m.ParallelResponses(r, requestOptions)
+
+	var err error
+
+	for _, resp := range resps {
+		if len(resp.errs) != 0 {
+			err = errors.Join(append(resp.errs, err)...)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resps) == 0 {
+		return nil, errors.New("no responses to merge")
+	}
+
+	outputCont := &gabs.Container{}
+	outputContArray := []*gabs.Container{}
+
+	for _, resp := range resps {
+
+		cont, err := gabs.ParseJSONBuffer(resp.response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if mergeOptions.EntryTransformer != nil {
+			newCont := (*mergeOptions.EntryTransformer)(m, cont)
+			cont = newCont
+		}
+
+		if mergeOptions.RootIsArray {
+			outputContArray = append(outputContArray, cont.Children()...)
+		} else {
+			if mergeOptions.CollisionFn != nil {
+				outputCont.MergeFn(cont, *mergeOptions.CollisionFn)
+			} else {
+				outputCont.Merge(cont)
+			}
+		}
+	}
+
+	if mergeOptions.RootIsArray {
+
+		if mergeOptions.ArrayUnique {
+			seen := map[string]bool{}
+			unique := []*gabs.Container{}
+			for _, entry := range outputContArray {
+				if key := entry.String(); !seen[key] {
+					seen[key] = true
+					unique = append(unique, entry)
+				}
+			}
+			outputContArray = unique
+		}
+
+		if mergeOptions.ArraySortFn != nil {
+			slices.SortStableFunc(outputContArray, *mergeOptions.ArraySortFn)
+		}
+
+		outputCont = gabs.Wrap(outputContArray)
+	}
+
+	if mergeOptions.OutputTransformer != nil {
+		newOutput := (*mergeOptions.OutputTransformer)(m, outputCont)
+		outputCont = newOutput
+	}
+
+	output := &http.Response{}
+	if m.Config.Format.PrettyPrint {
+		output.Body = io.NopCloser(bytes.NewBufferString(outputCont.StringIndent("", "  ")))
+	} else {
+		output.Body = io.NopCloser(bytes.NewBufferString(outputCont.String()))
+	}
+
+	output.Header = resps[0].response.Header.Clone()
+	output.Header.Del("Content-Length")
+	output.Request = r
+
+	return output, nil
+
+}
+
+func (m *Multiplexer) MakeResponse(err error, resp *http.Response, w http.ResponseWriter) {
+	if err == nil && resp != nil {
+		err = m.runPostMerge(resp)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		for header := range resp.Header {
+			w.Header().Add(header, resp.Header.Get(header))
+		}
+		if resp.StatusCode != 0 {
+			w.WriteHeader(resp.StatusCode)
+		}
+
+		// if resp.Request != nil && resp.Request.Header != nil && strings.Contains(resp.Request.Header.Get("Accept-Encoding"), "gzip") {
+		// 	w.Header().Add("Content-Encoding", "gzip")
+		// 	newWriter := gzip.NewWriter(w)
+		// 	io.Copy(newWriter, resp.Body)
+		// } else {
+		// 	io.Copy(w, resp.Body)
+		// }
+
+		io.Copy(w, resp.Body)
+
+	}
+}
+
+func SortRootGabsArrayByKey(m *Multiplexer, key string) (f *func(a, b *gabs.Container) int) {
+	retval := func(a, b *gabs.Container) int {
+		return strings.Compare(a.Path(key).String(), b.Path(key).String())
+	}
+	return &retval
+}
@@ -0,0 +1,303 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Requests are sent many at a time, so go test -race can see the shared state
+
+func TestParallelResponses(t *testing.T) {
+
+	servers := []*httptest.Server{}
+	for n := range 3 {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v2/torrents/info" {
+				io.WriteString(w, "[]")
+				return
+			}
+			io.WriteString(w, strconv.Itoa(n))
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+
+	g := sync.WaitGroup{}
+	for range 20 {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			r := httptest.NewRequest(http.MethodGet, "/api/v2/app/buildInfo", nil)
+			resps := m.ParallelResponses(r, RequestOptions{})
+			if len(resps) != len(servers) {
+				t.Errorf("got %d responses, want %d", len(resps), len(servers))
+				return
+			}
+			for n, resp := range resps {
+				if len(resp.errs) != 0 {
+					t.Error(resp.errs)
+					continue
+				}
+				body, _ := io.ReadAll(resp.response.Body)
+				resp.response.Body.Close()
+				if string(body) != strconv.Itoa(n) || resp.instance.Name != strconv.Itoa(n) {
+					t.Errorf("response %d is %q from instance %s", n, body, resp.instance.Name)
+				}
+			}
+		}()
+	}
+	g.Wait()
+
+}
+
+func TestHandlerTryAll(t *testing.T) {
+
+	servers := []*httptest.Server{}
+	for n := range 3 {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/api/v2/torrents/info":
+				io.WriteString(w, "[]")
+			case r.URL.Path == "/api/v2/torrents/properties" && r.FormValue("hash") == "hash1" && n == 1:
+				io.WriteString(w, `{"name":"one"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	tests := []struct {
+		hash   string
+		status int
+		body   string
+	}{
+		{"hash1", http.StatusOK, `{"name":"one"}`},
+		{"missing", http.StatusInternalServerError, "no successful responses\n"},
+	}
+
+	g := sync.WaitGroup{}
+	for range 10 {
+		for _, test := range tests {
+			g.Add(1)
+			go func() {
+				defer g.Done()
+				resp, err := http.Get(s.URL + "/api/v2/torrents/properties?hash=" + test.hash)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != test.status || string(body) != test.body {
+					t.Errorf("%s: got %d %q, want %d %q", test.hash, resp.StatusCode, body, test.status, test.body)
+				}
+			}()
+		}
+	}
+	g.Wait()
+
+	if owner, ok := m.Pool.Owner("hash1"); !ok || owner.Name != "1" {
+		t.Errorf("hash1 should be owned by instance 1, got %v", owner)
+	}
+	if _, ok := m.Pool.Owner("missing"); ok {
+		t.Error("missing should have no owner")
+	}
+
+}
+
+func TestMaindataStatistics(t *testing.T) {
+
+	statuses := []string{"connected", "firewalled", "connected"}
+
+	servers := []*httptest.Server{}
+	for n := range 3 {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v2/sync/maindata" {
+				io.WriteString(w, "[]")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"rid":         1,
+				"full_update": true,
+				"server_state": map[string]interface{}{
+					"dl_info_speed":     (n + 1) * 100,
+					"connection_status": statuses[n],
+				},
+			})
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	g := sync.WaitGroup{}
+	for range 20 {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			resp, err := http.Get(s.URL + "/api/v2/sync/maindata?rid=0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body := struct {
+				ServerState map[string]interface{} `json:"server_state"`
+			}{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Error(err)
+				return
+			}
+			if body.ServerState["dl_info_speed"] != float64(600) || body.ServerState["connection_status"] != "firewalled" {
+				t.Errorf("server_state %v, want dl_info_speed 600 and firewalled", body.ServerState)
+			}
+		}()
+	}
+	g.Wait()
+
+	m.Locks.Statistics.Lock()
+	defer m.Locks.Statistics.Unlock()
+	if len(m.Statistics) != len(servers) {
+		t.Errorf("statistics kept for %d instances, want %d", len(m.Statistics), len(servers))
+	}
+
+}
+
+func TestHandlerDrain(t *testing.T) {
+
+	// Instance 0 has torrents the ownership cache doesn't know about yet
+	torrents := []string{`[]`, `[]`}
+	added := make([]atomic.Int64, 2)
+
+	servers := []*httptest.Server{}
+	for n := range 2 {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/torrents/info":
+				io.WriteString(w, torrents[n])
+			case "/api/v2/torrents/add":
+				added[n].Add(1)
+				io.WriteString(w, "Ok.")
+			case "/api/v2/torrents/properties":
+				io.WriteString(w, `{"instance":`+strconv.Itoa(n)+`}`)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+	torrents[0] = `[{"hash":"a"},{"hash":"b"},{"hash":"c"}]`
+
+	send := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set(HeaderConfirm, "true")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method, target string
+		status         int
+		body           string
+	}{
+		{http.MethodGet, "/debug/drain?instance=0", http.StatusOK, " - active - 3 torrents"},
+		{http.MethodPost, "/debug/drain?instance=0", http.StatusOK, " - draining - 3 torrents"},
+		{http.MethodGet, "/debug/drain?instance=0", http.StatusOK, " - draining - 3 torrents"},
+		{http.MethodPost, "/debug/drain?instance=0&drain=maybe", http.StatusBadRequest, ""},
+		{http.MethodPost, "/debug/drain?instance=other", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := send(test.method, test.target)
+		if w.Code != test.status || !strings.HasSuffix(w.Body.String(), test.body) {
+			t.Errorf("%s %s: got %d %q, want %d ending in %q", test.method, test.target, w.Code, w.Body.String(), test.status, test.body)
+		}
+	}
+
+	// Still draining: new torrents go elsewhere, existing ones are served
+	for range 3 {
+		send(http.MethodPost, "/api/v2/torrents/add")
+	}
+	if added[0].Load() != 0 || added[1].Load() != 3 {
+		t.Errorf("torrents added %d and %d times, want none on the draining instance", added[0].Load(), added[1].Load())
+	}
+	if w := send(http.MethodGet, "/api/v2/torrents/properties?hash=b"); w.Body.String() != `{"instance":0}` {
+		t.Errorf("properties of a draining instance's torrent came from %s", w.Body.String())
+	}
+
+	send(http.MethodPost, "/debug/drain?instance=0&drain=false")
+	if m.Pool.ByName("0").Draining() {
+		t.Error("still draining after drain=false")
+	}
+
+}
+
+func TestHandlerTransferInfo(t *testing.T) {
+
+	infos := []string{
+		`{"dl_info_speed":100,"up_info_speed":10,"dl_rate_limit":1000,"up_rate_limit":0,"dht_nodes":5,"connection_status":"connected"}`,
+		`{"dl_info_speed":200,"up_info_speed":20,"dl_rate_limit":2000,"up_rate_limit":500,"dht_nodes":7,"connection_status":"firewalled"}`,
+	}
+
+	servers := []*httptest.Server{}
+	for n := range infos {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v2/transfer/info" {
+				io.WriteString(w, infos[n])
+				return
+			}
+			io.WriteString(w, "[]")
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+
+	tests := []struct {
+		target string
+		want   map[string]interface{}
+	}{
+		{"/api/v2/transfer/info", map[string]interface{}{
+			"dl_info_speed":     300.0,
+			"up_info_speed":     30.0,
+			"dl_rate_limit":     3000.0,
+			"up_rate_limit":     0.0, // One instance is unlimited
+			"dht_nodes":         12.0,
+			"connection_status": "firewalled",
+		}},
+		{"/api/v2/transfer/info?instances=true", map[string]interface{}{
+			"dl_info_speed": 300.0,
+			"instances": map[string]interface{}{
+				"0": map[string]interface{}{"dl_info_speed": 100.0, "up_info_speed": 10.0, "dl_rate_limit": 1000.0, "up_rate_limit": 0.0, "dht_nodes": 5.0, "connection_status": "connected"},
+				"1": map[string]interface{}{"dl_info_speed": 200.0, "up_info_speed": 20.0, "dl_rate_limit": 2000.0, "up_rate_limit": 500.0, "dht_nodes": 7.0, "connection_status": "firewalled"},
+			},
+		}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+		got := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: %v in %q", test.target, err, w.Body.String())
+			continue
+		}
+		for key, want := range test.want {
+			if !reflect.DeepEqual(got[key], want) {
+				t.Errorf("%s: %s is %v, want %v", test.target, key, got[key], want)
+			}
+		}
+		if _, ok := got["instances"]; ok != (test.want["instances"] != nil) {
+			t.Errorf("%s: breakdown included %v", test.target, ok)
+		}
+	}
+
+}
@@ -0,0 +1,107 @@
+package multiplexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// Hooks are run around every route, the upstream ones on every request sent
+// to an instance, background calls included. Register them before serving,
+// they are not guarded for changes while requests are in flight.
+type Hooks struct {
+	PreRoute         []PreRouteHook
+	UpstreamRequest  []UpstreamRequestHook
+	UpstreamResponse []UpstreamResponseHook
+	PostMerge        []PostMergeHook
+}
+
+// Runs before routing, returning false stops handling (the hook is expected to have responded)
+type PreRouteHook func(m *Multiplexer, w http.ResponseWriter, r *http.Request, route *Route) bool
+
+// Runs on each prepared upstream request, returning ErrSkipUpstream leaves the instance out
+type UpstreamRequestHook func(m *Multiplexer, i *qbittorrent.Instance, r *http.Request) error
+
+// Runs on each upstream response before it is merged or passed on
+type UpstreamResponseHook func(m *Multiplexer, i *qbittorrent.Instance, resp *http.Response) error
+
+// Runs on the final response before it is written, resp.Request is the upstream or client request
+type PostMergeHook func(m *Multiplexer, resp *http.Response) error
+
+var (
+	ErrSkipUpstream = errors.New("upstream skipped by hook")
+)
+
+func (m *Multiplexer) Use(hooks Hooks) {
+	m.Hooks.PreRoute = append(m.Hooks.PreRoute, hooks.PreRoute...)
+	m.Hooks.UpstreamRequest = append(m.Hooks.UpstreamRequest, hooks.UpstreamRequest...)
+	m.Hooks.UpstreamResponse = append(m.Hooks.UpstreamResponse, hooks.UpstreamResponse...)
+	m.Hooks.PostMerge = append(m.Hooks.PostMerge, hooks.PostMerge...)
+}
+
+func (m *Multiplexer) runPreRoute(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	for _, hook := range m.Hooks.PreRoute {
+		if !hook(m, w, r, route) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Multiplexer) runPostMerge(resp *http.Response) error {
+	for _, hook := range m.Hooks.PostMerge {
+		if err := hook(m, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachHooks has the instances run the upstream hooks on everything they
+// send, so typed calls (logs, search, preferences...) go through them too
+func (m *Multiplexer) attachHooks() {
+	for _, i := range m.Pool.All() {
+		i.SetHooks(qbittorrent.Hooks{
+			Request: func(r *http.Request) error {
+				for _, hook := range m.Hooks.UpstreamRequest {
+					if err := hook(m, i, r); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Response: func(resp *http.Response) error {
+				for _, hook := range m.Hooks.UpstreamResponse {
+					if err := hook(m, i, resp); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+}
+
+// ResponseBody reads the body and puts a copy back, so hooks can inspect it
+func ResponseBody(resp *http.Response) ([]byte, error) {
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// SetResponseBody replaces the body, keeping Content-Length in step
+func SetResponseBody(resp *http.Response, b []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	if resp.Header != nil && resp.Header.Get("Content-Length") != "" {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+}
@@ -0,0 +1,36 @@
+package multiplexer
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostRouter serves several pools on one listener, picked by the Host header
+type HostRouter struct {
+	Hosts   map[string]http.Handler
+	Default http.Handler
+}
+
+func NewHostRouter() *HostRouter {
+	return &HostRouter{
+		Hosts: map[string]http.Handler{},
+	}
+}
+
+func (h *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	if handler, ok := h.Hosts[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(w, r)
+	} else if h.Default != nil {
+		h.Default.ServeHTTP(w, r)
+	} else {
+		http.Error(w, "no pool for host: "+host, http.StatusNotFound)
+	}
+
+}
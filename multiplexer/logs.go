@@ -0,0 +1,256 @@
+package multiplexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	LogMain  = "main"
+	LogPeers = "peers"
+
+	// Entries kept per log, the oldest are dropped first
+	LogLimit = 10000
+)
+
+// Main log types, as bits
+var logTypes = map[string]int{
+	"normal":   1,
+	"info":     2,
+	"warning":  4,
+	"critical": 8,
+}
+
+// Log merges one log of every instance, kept in timestamp order. Entries get
+// ids from the multiplexer as they come in, so last_known_id works across the
+// pool, and an instance field naming their origin.
+type Log struct {
+	Kind    string
+	Entries []qbittorrent.LogEntry
+	Cursors map[*qbittorrent.Instance]LogCursor
+	NextID  int64
+
+	mutex sync.Mutex
+}
+
+// LogCursor is the last entry seen from an instance: its id there, -1 before
+// the first, and the entry itself to tell a restarted instance apart
+type LogCursor struct {
+	ID    int64
+	Entry string
+}
+
+func NewLog(kind string) *Log {
+	return &Log{
+		Kind:    kind,
+		Cursors: map[*qbittorrent.Instance]LogCursor{},
+	}
+}
+
+// Update fetches what's new from the instances and merges it in timestamp order
+func (l *Log) Update(instances []*qbittorrent.Instance) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cursors := make([]LogCursor, len(instances))
+	for n, instance := range instances {
+		cursor, ok := l.Cursors[instance]
+		if !ok {
+			cursor = LogCursor{ID: -1}
+		}
+		cursors[n] = cursor
+	}
+
+	fetched := make([][]qbittorrent.LogEntry, len(instances))
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) (err error) {
+		fetched[n], cursors[n], err = l.fetch(instance, cursors[n])
+		return
+	})
+	for n, err := range errs {
+		if err != nil {
+			log.Println("Fetching " + l.Kind + " log (" + instances[n].Host() + "): " + err.Error())
+			continue
+		}
+		l.Cursors[instances[n]] = cursors[n]
+	}
+
+	entries := []qbittorrent.LogEntry{}
+
+	for n, instance := range instances {
+		name := instance.Name
+		if name == "" {
+			name = instance.Host()
+		}
+		for _, entry := range fetched[n] {
+			entry["instance"] = name
+			entries = append(entries, entry)
+		}
+	}
+
+	slices.SortStableFunc(entries, compareLogEntries)
+
+	for _, entry := range entries {
+		entry["id"] = l.NextID
+		l.NextID += 1
+	}
+
+	// An instance that was late can bring entries older than what's merged
+	// already, they go in their place and what's already there stays first
+	l.Entries = append(l.Entries, entries...)
+	slices.SortStableFunc(l.Entries, compareLogEntries)
+	if len(l.Entries) > LogLimit {
+		l.Entries = slices.Clone(l.Entries[len(l.Entries)-LogLimit:])
+	}
+
+}
+
+func compareLogEntries(a, b qbittorrent.LogEntry) int {
+	at, bt := logEntryTimestamp(a), logEntryTimestamp(b)
+	if at < bt {
+		return -1
+	} else if at > bt {
+		return 1
+	}
+	return 0
+}
+
+// fetch returns the entries after the cursor and the new cursor. It asks from
+// the entry before the cursor: getting it back means nothing was missed, and
+// getting only later ones means it was pushed out of a busy log. Anything else
+// means the instance restarted and its ids started over, every entry it has is
+// then new.
+func (l *Log) fetch(instance *qbittorrent.Instance, cursor LogCursor) ([]qbittorrent.LogEntry, LogCursor, error) {
+
+	get := instance.MainLog
+	if l.Kind == LogPeers {
+		get = instance.PeerLog
+	}
+
+	if cursor.ID < 0 {
+		entries, err := get(-1)
+		return entries, lastLogCursor(entries, cursor), err
+	}
+
+	entries, err := get(cursor.ID - 1)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if len(entries) != 0 {
+		first := logEntryID(entries[0])
+		if first == cursor.ID && jsonString(entries[0]) == cursor.Entry {
+			return entries[1:], lastLogCursor(entries, cursor), nil
+		}
+		if first > cursor.ID {
+			return entries, lastLogCursor(entries, cursor), nil
+		}
+	}
+
+	log.Println("Reading " + l.Kind + " log again, ids went back (" + instance.Host() + ")")
+
+	entries, err = get(-1)
+	if err != nil {
+		return nil, cursor, err
+	}
+	return entries, lastLogCursor(entries, LogCursor{ID: -1}), nil
+
+}
+
+// lastLogCursor points at the newest of the entries, or stays put without any
+func lastLogCursor(entries []qbittorrent.LogEntry, cursor LogCursor) LogCursor {
+	for _, entry := range entries {
+		if id := logEntryID(entry); id > cursor.ID {
+			cursor = LogCursor{ID: id, Entry: jsonString(entry)}
+		}
+	}
+	return cursor
+}
+
+func logEntryID(entry qbittorrent.LogEntry) int64 {
+	id, _ := entry["id"].(float64)
+	return int64(id)
+}
+
+func logEntryTimestamp(entry qbittorrent.LogEntry) float64 {
+	timestamp, _ := entry["timestamp"].(float64)
+	return timestamp
+}
+
+// Since returns the entries after lastKnownID that keep passes, in timestamp
+// order. Ids go by arrival, so a late entry can have a higher id than newer ones.
+func (l *Log) Since(lastKnownID int64, keep func(qbittorrent.LogEntry) bool) []qbittorrent.LogEntry {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := []qbittorrent.LogEntry{}
+	for _, entry := range l.Entries {
+		if entry["id"].(int64) > lastKnownID && keep(entry) {
+			result = append(result, entry)
+		}
+	}
+	return result
+
+}
+
+// HandlerLog answers log/main and log/peers with the merged logs
+func (m *Multiplexer) HandlerLog(w http.ResponseWriter, r *http.Request) {
+
+	kind := strings.TrimPrefix(r.URL.Path, "/api/v2/log/")
+	l, ok := m.Logs[kind]
+	if !ok {
+		http.Error(w, "unknown log: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	lastKnownID := int64(-1)
+	if v := r.Form.Get("last_known_id"); v != "" {
+		var err error
+		lastKnownID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad last_known_id: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Every type is shown unless turned off, like qBittorrent does
+	types := 0
+	for name, bit := range logTypes {
+		if show, err := strconv.ParseBool(r.Form.Get(name)); err != nil || show {
+			types |= bit
+		}
+	}
+
+	l.Update(m.Pool.Ready())
+
+	entries := l.Since(lastKnownID, func(entry qbittorrent.LogEntry) bool {
+		if kind != LogMain {
+			return true
+		}
+		t, _ := entry["type"].(float64)
+		return int(t)&types != 0
+	})
+
+	body, err := json.Marshal(entries)
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+
+	m.MakeResponse(nil, &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, w)
+
+}
@@ -0,0 +1,121 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// fakeLog is the main log of an instance, answering last_known_id like qBittorrent
+type fakeLog struct {
+	mutex   sync.Mutex
+	entries []qbittorrent.LogEntry
+}
+
+func (f *fakeLog) set(entries ...qbittorrent.LogEntry) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.entries = entries
+}
+
+func (f *fakeLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lastKnownID, _ := strconv.ParseFloat(r.FormValue("last_known_id"), 64)
+	entries := []qbittorrent.LogEntry{}
+	for _, entry := range f.entries {
+		if entry["id"].(float64) > lastKnownID {
+			entries = append(entries, entry)
+		}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func logEntry(id, timestamp float64, message string) qbittorrent.LogEntry {
+	return qbittorrent.LogEntry{"id": id, "timestamp": timestamp, "message": message, "type": float64(1)}
+}
+
+func logInstance(t *testing.T, name string, f *fakeLog) *qbittorrent.Instance {
+	s := httptest.NewServer(f)
+	t.Cleanup(s.Close)
+	i, errs := (&qbittorrent.Config{URL: s.URL, Name: name}).New()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	return i
+}
+
+func logMessages(entries []qbittorrent.LogEntry) string {
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry["instance"].(string)+":"+entry["message"].(string))
+	}
+	return strings.Join(messages, " ")
+}
+
+func keepAll(qbittorrent.LogEntry) bool {
+	return true
+}
+
+func TestLogMergedInTimestampOrder(t *testing.T) {
+
+	first, second := &fakeLog{}, &fakeLog{}
+	first.set(logEntry(0, 10, "a"), logEntry(1, 20, "c"))
+	second.set(logEntry(0, 15, "b"))
+	a, b := logInstance(t, "a", first), logInstance(t, "b", second)
+
+	l := NewLog(LogMain)
+
+	// The second instance is late and brings an entry older than the newest one
+	l.Update([]*qbittorrent.Instance{a})
+	seen := l.Since(-1, keepAll)
+	l.Update([]*qbittorrent.Instance{a, b})
+
+	if got := logMessages(l.Since(-1, keepAll)); got != "a:a b:b a:c" {
+		t.Errorf("merged log is %q, want it in timestamp order", got)
+	}
+	lastKnownID := seen[len(seen)-1]["id"].(int64)
+	if got := logMessages(l.Since(lastKnownID, keepAll)); got != "b:b" {
+		t.Errorf("after id %d got %q, want only the late entry", lastKnownID, got)
+	}
+
+}
+
+func TestLogCursor(t *testing.T) {
+
+	f := &fakeLog{}
+	f.set(logEntry(0, 100, "a"), logEntry(1, 100, "b"))
+	i := logInstance(t, "i", f)
+
+	l := NewLog(LogMain)
+	l.Update([]*qbittorrent.Instance{i})
+
+	steps := []struct {
+		name    string
+		entries []qbittorrent.LogEntry
+		want    string
+	}{
+		{"nothing new", []qbittorrent.LogEntry{logEntry(0, 100, "a"), logEntry(1, 100, "b")}, ""},
+		{"appended", []qbittorrent.LogEntry{logEntry(0, 100, "a"), logEntry(1, 100, "b"), logEntry(2, 101, "c")}, "i:c"},
+		// Restarted within the same second, ids line up again
+		{"restarted", []qbittorrent.LogEntry{logEntry(0, 101, "d"), logEntry(1, 101, "e"), logEntry(2, 101, "f"), logEntry(3, 101, "g")}, "i:d i:e i:f i:g"},
+		{"restarted shorter", []qbittorrent.LogEntry{logEntry(0, 101, "h")}, "i:h"},
+		{"pushed out", []qbittorrent.LogEntry{logEntry(5, 102, "i"), logEntry(6, 102, "j")}, "i:i i:j"},
+	}
+
+	for _, step := range steps {
+		lastKnownID := l.NextID - 1
+		f.set(step.entries...)
+		l.Update([]*qbittorrent.Instance{i})
+		if got := logMessages(l.Since(lastKnownID, keepAll)); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+
+}
@@ -1,9 +1,18 @@
 package multiplexer
 
 import (
+	"context"
 	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
 )
 
 type Config struct {
@@ -16,8 +25,24 @@ type Config struct {
 		}
 	}
 	ShutdownTimeout time.Duration `default:"15s"`
+	Placement       string        `default:"leastbusy" usage:"Placement strategy for new torrents (leastbusy, roundrobin)"`
+	Routes          Routes        `usage:"Routing table entries, replacing the built in route of the same path"`
+	Policies        Policies      `usage:"Guards on dangerous endpoints, replacing the built in policy of the same path, field and value"`
+	Statistics      Statistics    `usage:"Aggregation per server_state key (sum, avg, min, max, worst-status, any, all, per-instance, ratio, limit)"`
+	Bandwidth       BandwidthConfig
+	AltSpeed        AltSpeedConfig
+	BannedIPs       BannedIPsConfig
+	Profiles        Profiles `usage:"Named sets of preferences, instances pick one with their Profile"`
+	ProfileSync     ProfilesConfig
+	Search          SearchConfig
+	RSS             RSSConfig
 }
 
+const (
+	PlacementLeastBusy  = "leastbusy"
+	PlacementRoundRobin = "roundrobin"
+)
+
 func (c Config) Validate() (errs []error) {
 
 	if c.Address == "" {
@@ -32,6 +57,187 @@ func (c Config) Validate() (errs []error) {
 		errs = append(errs, errors.New("(Multiplexer) Shutdown Timeout too low"))
 	}
 
+	switch c.Placement {
+	case "", PlacementLeastBusy, PlacementRoundRobin:
+	default:
+		errs = append(errs, errors.New("(Multiplexer) Unknown Placement: "+c.Placement))
+	}
+
+	errs = append(errs, c.Routes.Validate()...)
+	errs = append(errs, c.Policies.Validate()...)
+	errs = append(errs, c.Statistics.Validate()...)
+	errs = append(errs, c.Bandwidth.Validate()...)
+	errs = append(errs, c.AltSpeed.Validate()...)
+	errs = append(errs, c.BannedIPs.Validate()...)
+	errs = append(errs, c.Search.Validate()...)
+	errs = append(errs, c.RSS.Validate()...)
+
 	return errs
 
 }
+
+// Multiplexer serves a single pool of instances, several can run side by side
+type Multiplexer struct {
+	Name         string
+	Config       Config
+	Pool         *qbittorrent.Pool
+	Routes       Routes
+	Policies     Policies
+	Hooks        Hooks
+	Statistics   map[*qbittorrent.Instance]map[string]interface{} // Last known server_state of each instance
+	Limits       Limits
+	BannedIPs    BannedIPs
+	ProfileDrift map[*qbittorrent.Instance]ProfileDrift
+	Logs         map[string]*Log
+	Searches     Searches
+	RSS          RSS
+
+	Locks struct {
+		Statistics sync.Mutex
+		Limits     sync.Mutex
+		AltSpeed   sync.Mutex
+		BannedIPs  sync.Mutex
+		BanSync    sync.Mutex // Held through a whole sync or unban of the instances' lists
+		Profiles   sync.Mutex
+		Searches   sync.Mutex
+		RSS        sync.Mutex
+	}
+
+	balancer sync.Once
+	ctx      context.Context // Done once the multiplexer is closed
+	cancel   context.CancelFunc
+}
+
+func New(config Config, instances qbittorrent.Configs) (m *Multiplexer, errs []error) {
+
+	errs = append(errs, config.Validate()...)
+
+	pool, poolErrs := instances.NewPool()
+	errs = append(errs, poolErrs...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m = &Multiplexer{
+		ctx:        ctx,
+		cancel:     cancel,
+		Config:     config,
+		Pool:       pool,
+		Routes:     DefaultRoutes.Merge(config.Routes),
+		Policies:   DefaultPolicies.Merge(config.Policies),
+		Statistics: map[*qbittorrent.Instance]map[string]interface{}{},
+		BannedIPs: BannedIPs{
+			Drift: map[*qbittorrent.Instance]Drift{},
+		},
+		ProfileDrift: map[*qbittorrent.Instance]ProfileDrift{},
+		Logs: map[string]*Log{
+			LogMain:  NewLog(LogMain),
+			LogPeers: NewLog(LogPeers),
+		},
+		Searches: Searches{
+			Jobs:   map[int64]*Search{},
+			NextID: 1,
+		},
+	}
+
+	m.attachHooks()
+
+	errs = append(errs, m.validateProfiles()...)
+	errs = append(errs, m.validateRSS()...)
+	errs = append(errs, m.validatePolicies()...)
+
+	if config.RSS.Mode == RSSMultiplexer {
+		if err := m.loadRSS(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	m.Config.Statistics = DefaultStatistics.Merge(config.Statistics)
+
+	if len(errs) == 0 && (config.Bandwidth.Download != 0 || config.Bandwidth.Upload != 0) {
+		var download, upload *int64
+		if config.Bandwidth.Download != 0 {
+			download = &config.Bandwidth.Download
+		}
+		if config.Bandwidth.Upload != 0 {
+			upload = &config.Bandwidth.Upload
+		}
+		if err := m.SetLimits(download, upload); err != nil {
+			log.Println("Setting bandwidth limits: " + err.Error())
+		}
+	}
+
+	if len(errs) == 0 && len(config.AltSpeed.Schedule) != 0 {
+		go m.keepScheduling()
+	}
+
+	if len(errs) == 0 && config.BannedIPs.Enabled() {
+		go m.keepSyncingBannedIPs()
+	}
+
+	if len(errs) == 0 && slices.ContainsFunc(pool.All(), func(i *qbittorrent.Instance) bool { return i.Profile != "" }) {
+		go m.keepCheckingProfiles()
+	}
+
+	if len(errs) == 0 && config.RSS.Mode == RSSMultiplexer {
+		go m.keepRefreshingRSS()
+	}
+
+	return
+
+}
+
+// Close stops the background loops of the multiplexer and its pool
+func (m *Multiplexer) Close() {
+	m.cancel()
+	m.Pool.Close()
+}
+
+// wait sleeps for d, returning false instead once the multiplexer is closed
+func (m *Multiplexer) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-m.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Place picks the instance a new torrent is added to
+func (m *Multiplexer) Place() *qbittorrent.Instance {
+	return m.placeAfter(nil)
+}
+
+// placeAfter also counts torrents just added whose hash isn't known yet, so a
+// batch doesn't all land on the same instance
+func (m *Multiplexer) placeAfter(pending map[*qbittorrent.Instance]int) *qbittorrent.Instance {
+	switch m.Config.Placement {
+	case PlacementRoundRobin:
+		return m.Pool.NextRoundRobin()
+	}
+	return m.Pool.LeastBusyAfter(pending)
+}
+
+func (m *Multiplexer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.HandleAll(w, r)
+}
+
+func (m *Multiplexer) Prime() (errs []error) {
+
+	r := &http.Request{
+		URL: &url.URL{
+			Path: "/api/v2/torrents/info",
+		},
+		Form: url.Values{},
+	}
+
+	err := m.StreamTorrentsInfo(io.Discard, r)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	log.Println("Torrent list primed (" + m.Name + ")")
+
+	return errs
+}
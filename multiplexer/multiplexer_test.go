@@ -0,0 +1,92 @@
+package multiplexer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// fakeInstance answers app/version itself, handler gets everything else. It
+// has to answer torrents/info with an array too, the instance loads it to connect.
+func fakeInstance(t testing.TB, handler http.HandlerFunc) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/app/version" {
+			io.WriteString(w, "v4.6.0")
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestMultiplexer runs a multiplexer over the servers, named by their index
+func newTestMultiplexer(t testing.TB, config Config, servers ...*httptest.Server) *Multiplexer {
+
+	if config.Address == "" {
+		config.Address = "127.0.0.1"
+	}
+	if config.Port == 0 {
+		config.Port = 9955
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5 * time.Second
+	}
+
+	configs := qbittorrent.Configs{}
+	for n, s := range servers {
+		configs = append(configs, &qbittorrent.Config{URL: s.URL, Name: strconv.Itoa(n)})
+	}
+
+	m, errs := New(config, configs)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	t.Cleanup(m.Close)
+
+	return m
+
+}
+
+func TestCloseStopsLoginRefresh(t *testing.T) {
+
+	logins := atomic.Int64{}
+	s := fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/auth/login":
+			logins.Add(1)
+			http.SetCookie(w, &http.Cookie{Name: "SID", Value: "1", Path: "/"})
+			io.WriteString(w, "Ok.")
+		default:
+			io.WriteString(w, "[]")
+		}
+	})
+
+	m, errs := New(Config{Address: "127.0.0.1", Port: 9955, ShutdownTimeout: 5 * time.Second}, qbittorrent.Configs{
+		{URL: s.URL, Username: "user", Password: "pass", CookieTimeout: 100 * time.Millisecond},
+	})
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	// Logins are refreshed in the background shortly before they expire
+	time.Sleep(250 * time.Millisecond)
+	if n := logins.Load(); n < 2 {
+		t.Fatalf("logged in %d times, want background refreshes", n)
+	}
+
+	m.Close()
+	time.Sleep(50 * time.Millisecond) // A refresh already under way finishes
+	closed := logins.Load()
+	time.Sleep(300 * time.Millisecond)
+	if n := logins.Load(); n != closed {
+		t.Errorf("logged in %d more times after Close", n-closed)
+	}
+
+}
@@ -0,0 +1,166 @@
+package multiplexer
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	PolicyAllow    = "allow"    // Handled as usual
+	PolicyRedirect = "redirect" // Sent to the instance named in the policy only
+	PolicyConfirm  = "confirm"  // Refused unless the request carries HeaderConfirm
+	PolicyBlock    = "block"    // Always refused
+
+	HeaderConfirm = "X-Multiplexer-Confirm"
+)
+
+// Stricter actions win when several policies match
+var policyActions = []string{PolicyAllow, PolicyRedirect, PolicyConfirm, PolicyBlock}
+
+// A Policy guards an endpoint, optionally only for one method or when a form
+// field has a value. They apply to requests sent to a single instance too,
+// except redirect.
+type Policy struct {
+	Path     string `usage:"API path, a trailing / matches as a prefix"`
+	Method   string `usage:"HTTP method the policy applies to, any if empty"`
+	Field    string `usage:"Form field the policy depends on, always applies if empty"`
+	Value    string `usage:"Value of Field the policy applies to (case insensitive), any non empty value if empty"`
+	Action   string `usage:"What happens to matching requests (allow, redirect, confirm, block)"`
+	Instance string `usage:"Instance name for the redirect action"`
+}
+
+type Policies []*Policy
+
+var DefaultPolicies = Policies{
+	{Path: "/api/v2/app/shutdown", Action: PolicyBlock},
+	{Path: "/api/v2/app/setPreferences", Action: PolicyConfirm},
+	{Path: "/api/v2/torrents/delete", Field: "deleteFiles", Value: "true", Action: PolicyConfirm},
+	{Path: "/api/v2/torrents/delete", Field: "hashes", Value: "all", Action: PolicyConfirm},
+	{Path: "/debug/drain", Method: http.MethodPost, Action: PolicyConfirm},
+	{Path: "/debug/expirelogins", Action: PolicyConfirm},
+	{Path: "/debug/profiles", Method: http.MethodPost, Field: "enforce", Value: "true", Action: PolicyConfirm},
+	{Path: "/debug/bannedips", Method: http.MethodPost, Field: "unban", Action: PolicyConfirm},
+}
+
+// Merge returns a copy of the policies with overrides replacing entries of the same path, method, field and value
+func (policies Policies) Merge(overrides Policies) (merged Policies) {
+	merged = slices.Clone(policies)
+	for _, override := range overrides {
+		idx := slices.IndexFunc(merged, func(p *Policy) bool {
+			return p.Path == override.Path && strings.EqualFold(p.Method, override.Method) && p.Field == override.Field && strings.EqualFold(p.Value, override.Value)
+		})
+		if idx >= 0 {
+			merged[idx] = override
+		} else {
+			merged = append(merged, override)
+		}
+	}
+	return
+}
+
+func (policies Policies) Validate() (errs []error) {
+	for _, policy := range policies {
+		if !strings.HasPrefix(policy.Path, "/") {
+			errs = append(errs, errors.New("(Policies) Path must start with /: "+policy.Path))
+		}
+		if !slices.Contains(policyActions, policy.Action) {
+			errs = append(errs, errors.New("(Policies) Unknown Action for "+policy.Path+": "+policy.Action))
+		}
+		if policy.Action == PolicyRedirect && policy.Instance == "" {
+			errs = append(errs, errors.New("(Policies) No Instance for redirect policy "+policy.Path))
+		}
+	}
+	return
+}
+
+func (m *Multiplexer) validatePolicies() (errs []error) {
+	for _, policy := range m.Policies {
+		if policy.Action == PolicyRedirect && policy.Instance != "" && m.Pool.ByName(policy.Instance) == nil {
+			errs = append(errs, errors.New("(Policies) Unknown Instance for "+policy.Path+": "+policy.Instance))
+		}
+	}
+	return
+}
+
+// Match returns the strictest policy for the request, nil if none applies
+func (policies Policies) Match(method, path string, form url.Values) (match *Policy) {
+	for _, policy := range policies {
+		if policy.Path != path && !(strings.HasSuffix(policy.Path, "/") && strings.HasPrefix(path, policy.Path)) {
+			continue
+		}
+		if policy.Method != "" && !strings.EqualFold(policy.Method, method) {
+			continue
+		}
+		if policy.Field != "" {
+			value := form.Get(policy.Field)
+			if value == "" || (policy.Value != "" && !strings.EqualFold(value, policy.Value)) {
+				continue
+			}
+		}
+		if match == nil || slices.Index(policyActions, policy.Action) > slices.Index(policyActions, match.Action) {
+			match = policy
+		}
+	}
+	return
+}
+
+// checkPolicy answers requests the policies refuse, returning false for them.
+// Routed requests a redirect policy applies to get the instance to go to.
+func (m *Multiplexer) checkPolicy(w http.ResponseWriter, r *http.Request) (*qbittorrent.Instance, bool) {
+
+	path := r.URL.Path
+	target := ""
+	if rest, ok := strings.CutPrefix(path, PathPrefixInstance); ok {
+		target, path, _ = strings.Cut(rest, "/")
+		path = "/" + path
+	} else {
+		target = r.Header.Get(HeaderInstance)
+	}
+
+	policy := m.Policies.Match(r.Method, path, r.Form)
+	if policy == nil {
+		return nil, true
+	}
+
+	describe := path + " from " + r.RemoteAddr
+	if target != "" {
+		describe += " to " + target
+	}
+
+	switch policy.Action {
+	case PolicyBlock:
+		log.Println("Policy blocked " + describe + " (" + m.Name + ")")
+		http.Error(w, "blocked by multiplexer policy: "+path, http.StatusForbidden)
+		return nil, false
+
+	case PolicyConfirm:
+		if confirmed, _ := strconv.ParseBool(r.Header.Get(HeaderConfirm)); !confirmed {
+			log.Println("Policy refused unconfirmed " + describe + " (" + m.Name + ")")
+			http.Error(w, "confirmation required by multiplexer policy, send "+HeaderConfirm+": true to go ahead: "+path, http.StatusPreconditionRequired)
+			return nil, false
+		}
+		log.Println("Policy let confirmed " + describe + " through (" + m.Name + ")")
+
+	case PolicyRedirect:
+		if target != "" {
+			return nil, true
+		}
+		i := m.Pool.ByName(policy.Instance)
+		if i == nil {
+			http.Error(w, "unknown instance: "+policy.Instance, http.StatusNotFound)
+			return nil, false
+		}
+		log.Println("Policy redirected " + describe + " to " + policy.Instance + " (" + m.Name + ")")
+		return i, true
+	}
+
+	return nil, true
+
+}
@@ -0,0 +1,101 @@
+package multiplexer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckPolicy(t *testing.T) {
+
+	instance := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[]")
+	}
+	m := newTestMultiplexer(t, Config{Policies: Policies{
+		{Path: "/api/v2/torrents/add", Action: PolicyRedirect, Instance: "1"},
+		{Path: "/debug/expirelogins", Action: PolicyAllow},
+	}}, fakeInstance(t, instance), fakeInstance(t, instance))
+
+	tests := []struct {
+		method   string
+		path     string
+		header   string // Header set to "true"
+		status   int    // 200 when let through
+		redirect string // Instance the request goes to
+	}{
+		{http.MethodGet, "/api/v2/torrents/info", "", http.StatusOK, ""},
+		{http.MethodPost, "/debug/expirelogins", "", http.StatusOK, ""}, // Allowed over the built in confirm
+		{http.MethodPost, "/api/v2/app/shutdown", "", http.StatusForbidden, ""},
+		{http.MethodPost, "/api/v2/app/shutdown", HeaderConfirm, http.StatusForbidden, ""},
+		{http.MethodPost, "/api/v2/app/setPreferences", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/api/v2/app/setPreferences", HeaderConfirm, http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/torrents/delete?hashes=abc&deleteFiles=false", "", http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/torrents/delete?hashes=abc&deleteFiles=true", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/api/v2/torrents/delete?hashes=all&deleteFiles=false", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/api/v2/torrents/delete?hashes=ALL&deleteFiles=false", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/api/v2/torrents/delete?hashes=all&deleteFiles=true", HeaderConfirm, http.StatusOK, ""},
+		{http.MethodGet, "/debug/drain", "", http.StatusOK, ""}, // Only POST changes anything
+		{http.MethodPost, "/debug/drain?instance=0", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/api/v2/torrents/add", "", http.StatusOK, "1"},
+		// Requests for a single instance are guarded too, but not redirected
+		{http.MethodPost, "/instance/0/api/v2/app/shutdown", "", http.StatusForbidden, ""},
+		{http.MethodPost, "/instance/0/api/v2/torrents/delete?hashes=all", "", http.StatusPreconditionRequired, ""},
+		{http.MethodPost, "/instance/0/api/v2/torrents/delete?hashes=abc", "", http.StatusOK, ""},
+		{http.MethodPost, "/instance/0/api/v2/torrents/add", "", http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/torrents/add", HeaderInstance, http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.header == HeaderInstance {
+			r.Header.Set(HeaderInstance, "0")
+		} else if test.header != "" {
+			r.Header.Set(test.header, "true")
+		}
+		r.ParseForm()
+
+		w := httptest.NewRecorder()
+		redirect, ok := m.checkPolicy(w, r)
+
+		if ok != (test.status == http.StatusOK) || w.Code != test.status {
+			t.Errorf("%s %s (%s): got %d and %v, want %d", test.method, test.path, test.header, w.Code, ok, test.status)
+		}
+		name := ""
+		if redirect != nil {
+			name = redirect.Name
+		}
+		if name != test.redirect {
+			t.Errorf("%s %s (%s): redirected to %q, want %q", test.method, test.path, test.header, name, test.redirect)
+		}
+	}
+
+	// Refused before anything reaches an instance
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v2/torrents/delete?hashes=all", nil))
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("served delete of all torrents with %d, want 428", w.Code)
+	}
+
+}
+
+func TestPoliciesValidate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		policies Policies
+		errs     int
+	}{
+		{"defaults", DefaultPolicies, 0},
+		{"relative path", Policies{{Path: "api/v2/app/shutdown", Action: PolicyBlock}}, 1},
+		{"unknown action", Policies{{Path: "/api/v2/app/shutdown", Action: "deny"}}, 1},
+		{"redirect without instance", Policies{{Path: "/api/v2/torrents/add", Action: PolicyRedirect}}, 1},
+	}
+
+	for _, test := range tests {
+		if errs := test.policies.Validate(); len(errs) != test.errs {
+			t.Errorf("%s: got %v, want %d errors", test.name, errs, test.errs)
+		}
+	}
+
+}
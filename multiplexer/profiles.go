@@ -0,0 +1,186 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const DefaultProfilesInterval = 10 * time.Minute
+
+// Profiles are named sets of preferences, assigned to instances with their Profile field
+type Profiles map[string]qbittorrent.Preferences
+
+type ProfilesConfig struct {
+	Enforce  bool          `usage:"Push the profile back onto instances that drifted from it"`
+	Interval time.Duration `default:"10m" usage:"How often instances are compared with their profile"`
+}
+
+// Difference is a preference an instance doesn't have at its profile's value
+type Difference struct {
+	Key  string
+	Want interface{}
+	Have interface{} // nil if the instance doesn't know the preference
+}
+
+type ProfileDrift struct {
+	Profile     string
+	Differences []Difference
+	Checked     time.Time
+	Err         error
+}
+
+func (d ProfileDrift) String() string {
+	if d.Err != nil {
+		return d.Profile + " - error - " + d.Err.Error()
+	}
+	lines := []string{d.Profile + " - " + strconv.Itoa(len(d.Differences)) + " differences - checked " + d.Checked.Format(time.RFC3339)}
+	for _, difference := range d.Differences {
+		lines = append(lines, "  "+difference.Key+": want "+jsonString(difference.Want)+", have "+jsonString(difference.Have))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func (m *Multiplexer) validateProfiles() (errs []error) {
+	for _, instance := range m.Pool.All() {
+		if _, ok := m.Config.Profiles[instance.Profile]; instance.Profile != "" && !ok {
+			errs = append(errs, errors.New("(Profiles) Unknown Profile: "+instance.Profile))
+		}
+	}
+	return
+}
+
+func (m *Multiplexer) keepCheckingProfiles() {
+	interval := m.Config.ProfileSync.Interval
+	if interval <= 0 {
+		interval = DefaultProfilesInterval
+	}
+	for {
+		if err := m.CheckProfiles(m.Config.ProfileSync.Enforce); err != nil {
+			log.Println("Checking preference profiles (" + m.Name + "): " + err.Error())
+		}
+		if !m.wait(interval) {
+			return
+		}
+	}
+}
+
+// CheckProfiles compares every ready instance that has a profile with it,
+// setting the differing preferences when enforce is set
+func (m *Multiplexer) CheckProfiles(enforce bool) error {
+
+	instances := []*qbittorrent.Instance{}
+	for _, instance := range m.Pool.Ready() {
+		if instance.Profile != "" {
+			instances = append(instances, instance)
+		}
+	}
+
+	drifts := make([]ProfileDrift, len(instances))
+	ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		drifts[n] = m.checkProfile(instance, enforce)
+		return nil
+	})
+
+	m.Locks.Profiles.Lock()
+	defer m.Locks.Profiles.Unlock()
+
+	errs := []error{}
+	for n, instance := range instances {
+		m.ProfileDrift[instance] = drifts[n]
+		if drifts[n].Err != nil {
+			errs = append(errs, errors.New("("+instance.Host()+") "+drifts[n].Err.Error()))
+		}
+	}
+
+	return errors.Join(errs...)
+
+}
+
+func (m *Multiplexer) checkProfile(instance *qbittorrent.Instance, enforce bool) (drift ProfileDrift) {
+
+	drift.Profile = instance.Profile
+	drift.Checked = time.Now()
+
+	profile := m.Config.Profiles[instance.Profile]
+
+	preferences, err := instance.Preferences()
+	if err != nil {
+		drift.Err = err
+		return
+	}
+
+	corrections := qbittorrent.Preferences{}
+	for key, want := range profile {
+		have, ok := preferences[key]
+		// Compared as JSON, numbers from the config and the API have different types
+		if ok && jsonString(have) == jsonString(want) {
+			continue
+		}
+		drift.Differences = append(drift.Differences, Difference{Key: key, Want: want, Have: have})
+		corrections[key] = want
+	}
+
+	slices.SortFunc(drift.Differences, func(a, b Difference) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if len(drift.Differences) == 0 {
+		return
+	}
+
+	log.Println("Preferences drifted from " + instance.Profile + " (" + instance.Host() + "): " + strconv.Itoa(len(drift.Differences)) + " differences")
+
+	if enforce {
+		drift.Err = instance.SetPreferences(corrections)
+	}
+
+	return
+
+}
+
+// HandlerProfiles reports how each instance differs from its profile. POST
+// checks again first, and with enforce=true also corrects the differences.
+func (m *Multiplexer) HandlerProfiles(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPost {
+		enforce, _ := strconv.ParseBool(r.Form.Get("enforce"))
+		m.CheckProfiles(enforce || m.Config.ProfileSync.Enforce)
+	}
+
+	body := []string{}
+
+	m.Locks.Profiles.Lock()
+	for _, instance := range m.Pool.All() {
+		line := instance.String() + " - "
+		if instance.Profile == "" {
+			line += "no profile"
+		} else if drift, ok := m.ProfileDrift[instance]; ok {
+			line += drift.String()
+		} else {
+			line += instance.Profile + " - not checked yet"
+		}
+		body = append(body, line)
+	}
+	m.Locks.Profiles.Unlock()
+
+	m.MakeResponse(nil, &http.Response{Body: io.NopCloser(strings.NewReader(strings.Join(body, "\n")))}, w)
+
+}
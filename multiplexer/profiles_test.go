@@ -0,0 +1,96 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+func TestCheckProfiles(t *testing.T) {
+
+	profiles := Profiles{
+		"seedbox": {
+			"max_active_downloads": 5, // An int from the config, a float from the API
+			"dht":                  false,
+			"save_path":            "/data",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		preferences map[string]interface{}
+		differences []Difference
+	}{
+		{"matching", map[string]interface{}{"max_active_downloads": 5, "dht": false, "save_path": "/data", "other": 1}, nil},
+		{"drifted", map[string]interface{}{"max_active_downloads": 3, "dht": false, "save_path": "/data"}, []Difference{
+			{Key: "max_active_downloads", Want: 5, Have: 3.0},
+		}},
+		{"unknown preference", map[string]interface{}{"max_active_downloads": 5, "dht": true}, []Difference{
+			{Key: "dht", Want: false, Have: true},
+			{Key: "save_path", Want: "/data", Have: nil},
+		}},
+	}
+
+	for _, test := range tests {
+		for _, enforce := range []bool{false, true} {
+
+			mutex := sync.Mutex{}
+			preferences := map[string]interface{}{}
+			for key, value := range test.preferences {
+				preferences[key] = value
+			}
+
+			s := fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				switch r.URL.Path {
+				case "/api/v2/app/preferences":
+					json.NewEncoder(w).Encode(preferences)
+				case "/api/v2/app/setPreferences":
+					json.Unmarshal([]byte(r.FormValue("json")), &preferences)
+				default:
+					io.WriteString(w, "[]")
+				}
+			})
+			m, errs := New(Config{
+				Address:         "127.0.0.1",
+				Port:            9955,
+				ShutdownTimeout: 5 * time.Second,
+				Profiles:        profiles,
+			}, qbittorrent.Configs{{URL: s.URL, Profile: "seedbox"}})
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			t.Cleanup(m.Close)
+			instance := m.Pool.All()[0]
+
+			if err := m.CheckProfiles(enforce); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+
+			m.Locks.Profiles.Lock()
+			drift := m.ProfileDrift[instance]
+			m.Locks.Profiles.Unlock()
+			if drift.Profile != "seedbox" || !reflect.DeepEqual(drift.Differences, test.differences) {
+				t.Errorf("%s: got %+v, want %+v", test.name, drift, test.differences)
+			}
+
+			// Enforcing leaves nothing to correct
+			m.CheckProfiles(false)
+			m.Locks.Profiles.Lock()
+			drift = m.ProfileDrift[instance]
+			m.Locks.Profiles.Unlock()
+			if enforced := len(drift.Differences) == 0; enforced != (enforce || test.differences == nil) {
+				t.Errorf("%s: enforce %v left %+v", test.name, enforce, drift.Differences)
+			}
+
+		}
+	}
+
+}
@@ -0,0 +1,488 @@
+package multiplexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+type Strategy string
+
+const (
+	StrategyMergeArray    = Strategy("merge-array")     // JSON arrays from every instance, concatenated and de-duplicated
+	StrategyMergeObject   = Strategy("merge-object")    // JSON objects from every instance, merged
+	StrategyBroadcast     = Strategy("broadcast")       // Sent to every instance
+	StrategyRouteByHash   = Strategy("route-by-hash")   // Sent to the owner of the hash field
+	StrategyRouteByHashes = Strategy("route-by-hashes") // Split by owner of the hashes field
+	StrategyMergeByHashes = Strategy("merge-by-hashes") // Split by owner of the hashes field, JSON objects merged
+	StrategyLeastBusy     = Strategy("least-busy")      // Sent to the instance with the fewest torrents
+	StrategyRoundRobin    = Strategy("round-robin")     // Sent to the next instance in turn
+	StrategyPinned        = Strategy("pinned-instance") // Sent to the instance named in the route
+	StrategyReject        = Strategy("reject")          // Refused by the multiplexer
+
+	// Built in handlers for specific endpoints
+	StrategyLogin        = Strategy("login")
+	StrategyMaindata     = Strategy("maindata")
+	StrategyTransferInfo = Strategy("transfer-info")
+	StrategyLimits       = Strategy("limits")
+	StrategyAltSpeed     = Strategy("alt-speed")
+	StrategyBanPeers     = Strategy("ban-peers")
+	StrategyLog          = Strategy("log")
+	StrategySearch       = Strategy("search")
+	StrategyRSS          = Strategy("rss")
+	StrategyTorrentsInfo = Strategy("torrents-info")
+	StrategyPlace        = Strategy("place")
+)
+
+var Strategies = []Strategy{
+	StrategyMergeArray,
+	StrategyMergeObject,
+	StrategyBroadcast,
+	StrategyRouteByHash,
+	StrategyRouteByHashes,
+	StrategyMergeByHashes,
+	StrategyLeastBusy,
+	StrategyRoundRobin,
+	StrategyPinned,
+	StrategyReject,
+	StrategyLogin,
+	StrategyMaindata,
+	StrategyTransferInfo,
+	StrategyLimits,
+	StrategyAltSpeed,
+	StrategyBanPeers,
+	StrategyLog,
+	StrategySearch,
+	StrategyRSS,
+	StrategyTorrentsInfo,
+	StrategyPlace,
+}
+
+// A Path ending in / matches everything below it, the longest match wins
+type Route struct {
+	Path     string   `usage:"API path, a trailing / matches as a prefix"`
+	Strategy Strategy `usage:"How requests to the path are handled"`
+	Instance string   `usage:"Instance name for the pinned-instance strategy"`
+}
+
+type Routes []*Route
+
+func routes(strategy Strategy, paths ...string) (r Routes) {
+	for _, path := range paths {
+		r = append(r, &Route{Path: path, Strategy: strategy})
+	}
+	return
+}
+
+var DefaultRoutes = slices.Concat(
+	routes(StrategyRoundRobin,
+		"/",
+		"/api/v2/",
+	),
+	routes(StrategyLogin,
+		"/api/v2/auth/login",
+		"/api/v2/auth/logout",
+	),
+	routes(StrategyMaindata,
+		"/api/v2/sync/maindata",
+	),
+	routes(StrategyTransferInfo,
+		"/api/v2/transfer/info",
+	),
+	routes(StrategyLimits,
+		"/api/v2/transfer/downloadLimit",
+		"/api/v2/transfer/uploadLimit",
+		"/api/v2/transfer/setDownloadLimit",
+		"/api/v2/transfer/setUploadLimit",
+	),
+	routes(StrategyAltSpeed,
+		"/api/v2/transfer/speedLimitsMode",
+		"/api/v2/transfer/toggleSpeedLimitsMode",
+		"/api/v2/transfer/setSpeedLimitsMode",
+	),
+	routes(StrategyBanPeers,
+		"/api/v2/transfer/banPeers",
+	),
+	routes(StrategyLog,
+		"/api/v2/log/main",
+		"/api/v2/log/peers",
+	),
+	routes(StrategySearch,
+		"/api/v2/search/start",
+		"/api/v2/search/stop",
+		"/api/v2/search/status",
+		"/api/v2/search/results",
+		"/api/v2/search/delete",
+	),
+	routes(StrategyRSS,
+		"/api/v2/rss/",
+	),
+	routes(StrategyTorrentsInfo,
+		"/api/v2/torrents/info",
+	),
+	routes(StrategyPlace,
+		"/api/v2/torrents/add",
+	),
+	routes(StrategyRouteByHash,
+		"/api/v2/sync/torrentPeers",
+		"/api/v2/torrents/properties",
+		"/api/v2/torrents/trackers",
+		"/api/v2/torrents/webseeds",
+		"/api/v2/torrents/files",
+		"/api/v2/torrents/pieceStates",
+		"/api/v2/torrents/pieceHashes",
+		"/api/v2/torrents/editTracker",
+		"/api/v2/torrents/addTrackers",
+		"/api/v2/torrents/removeTrackers",
+		"/api/v2/torrents/addWebSeeds",
+		"/api/v2/torrents/editWebSeed",
+		"/api/v2/torrents/removeWebSeeds",
+		"/api/v2/torrents/filePrio",
+		"/api/v2/torrents/rename",
+		"/api/v2/torrents/renameFile",
+		"/api/v2/torrents/renameFolder",
+		"/api/v2/torrents/export",
+	),
+	routes(StrategyRouteByHashes,
+		"/api/v2/torrents/pause",
+		"/api/v2/torrents/resume",
+		"/api/v2/torrents/stop",
+		"/api/v2/torrents/start",
+		"/api/v2/torrents/delete",
+		"/api/v2/torrents/recheck",
+		"/api/v2/torrents/reannounce",
+		"/api/v2/torrents/increasePrio",
+		"/api/v2/torrents/decreasePrio",
+		"/api/v2/torrents/topPrio",
+		"/api/v2/torrents/bottomPrio",
+		"/api/v2/torrents/setDownloadLimit",
+		"/api/v2/torrents/setUploadLimit",
+		"/api/v2/torrents/setShareLimits",
+		"/api/v2/torrents/setLocation",
+		"/api/v2/torrents/setCategory",
+		"/api/v2/torrents/addTags",
+		"/api/v2/torrents/removeTags",
+		"/api/v2/torrents/setTags",
+		"/api/v2/torrents/setAutoManagement",
+		"/api/v2/torrents/toggleSequentialDownload",
+		"/api/v2/torrents/toggleFirstLastPiecePrio",
+		"/api/v2/torrents/setForceStart",
+		"/api/v2/torrents/setSuperSeeding",
+		"/api/v2/torrents/addPeers",
+	),
+	routes(StrategyMergeByHashes,
+		"/api/v2/torrents/downloadLimit",
+		"/api/v2/torrents/uploadLimit",
+	),
+	routes(StrategyMergeObject,
+		"/api/v2/torrents/categories",
+	),
+	routes(StrategyMergeArray,
+		"/api/v2/torrents/tags",
+		"/api/v2/search/plugins",
+	),
+	routes(StrategyBroadcast,
+		"/api/v2/torrents/createCategory",
+		"/api/v2/torrents/editCategory",
+		"/api/v2/torrents/removeCategories",
+		"/api/v2/torrents/createTags",
+		"/api/v2/torrents/deleteTags",
+		"/api/v2/search/installPlugin",
+		"/api/v2/search/uninstallPlugin",
+		"/api/v2/search/enablePlugin",
+		"/api/v2/search/updatePlugins",
+	),
+)
+
+// Merge returns a copy of the routes with overrides replacing entries of the same path
+func (routes Routes) Merge(overrides Routes) (merged Routes) {
+	merged = slices.Clone(routes)
+	for _, override := range overrides {
+		idx := slices.IndexFunc(merged, func(r *Route) bool {
+			return r.Path == override.Path
+		})
+		if idx >= 0 {
+			merged[idx] = override
+		} else {
+			merged = append(merged, override)
+		}
+	}
+	return
+}
+
+func (routes Routes) Match(path string) (match *Route) {
+	for _, route := range routes {
+		if route.Path == path || (strings.HasSuffix(route.Path, "/") && strings.HasPrefix(path, route.Path)) {
+			if match == nil || len(route.Path) > len(match.Path) {
+				match = route
+			}
+		}
+	}
+	return
+}
+
+func (routes Routes) Validate() (errs []error) {
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			errs = append(errs, errors.New("(Routes) Path must start with /: "+route.Path))
+		}
+		if !slices.Contains(Strategies, route.Strategy) {
+			errs = append(errs, errors.New("(Routes) Unknown Strategy for "+route.Path+": "+string(route.Strategy)))
+		}
+		if route.Strategy == StrategyPinned && route.Instance == "" {
+			errs = append(errs, errors.New("(Routes) No Instance for pinned route "+route.Path))
+		}
+	}
+	return
+}
+
+func (m *Multiplexer) HandleRoute(w http.ResponseWriter, r *http.Request, route *Route) {
+
+	log.Println("Route " + route.Path + " - " + string(route.Strategy))
+
+	switch route.Strategy {
+	case StrategyLogin:
+		m.HandlerLogin(w, r)
+	case StrategyMaindata:
+		resp, err := m.HandlerTorrentsMaindata(r)
+		m.MakeResponse(err, resp, w)
+	case StrategyTransferInfo:
+		resp, err := m.HandlerTransferInfo(r)
+		m.MakeResponse(err, resp, w)
+	case StrategyLimits:
+		m.HandlerLimits(w, r)
+	case StrategyAltSpeed:
+		m.HandlerSpeedLimitsMode(w, r)
+	case StrategyBanPeers:
+		m.HandlerBanPeers(w, r)
+	case StrategyLog:
+		m.HandlerLog(w, r)
+	case StrategySearch:
+		m.HandlerSearch(w, r)
+	case StrategyRSS:
+		m.HandlerRSS(w, r)
+	case StrategyTorrentsInfo:
+		// Post merge hooks need the whole body, so only stream without them
+		if len(m.Hooks.PostMerge) != 0 {
+			body := &bytes.Buffer{}
+			err := m.StreamTorrentsInfo(body, r)
+			m.MakeResponse(err, &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       io.NopCloser(body),
+				Request:    r,
+			}, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := m.StreamTorrentsInfo(w, r)
+		if errors.Is(err, ErrStreamCut) {
+			// Dropping the connection is the only way left to tell the client
+			log.Println(err)
+			panic(http.ErrAbortHandler)
+		} else if err != nil {
+			m.MakeResponse(err, nil, w)
+		}
+	case StrategyPlace:
+		m.HandlerPlace(w, r)
+	case StrategyMergeArray:
+		resp, err := m.HandlerMergeJSON(r, RequestOptions{}, MergeOptions{
+			RootIsArray: true,
+			ArrayUnique: true,
+		})
+		m.MakeResponse(err, resp, w)
+	case StrategyMergeObject:
+		resp, err := m.HandlerMergeJSON(r, RequestOptions{}, MergeOptions{
+			CollisionFn: &CollisionReplace,
+		})
+		m.MakeResponse(err, resp, w)
+	case StrategyBroadcast:
+		m.HandlerBroadcast(w, r)
+	case StrategyRouteByHash:
+		m.HandlerRouteByHash(w, r)
+	case StrategyRouteByHashes:
+		m.HandlerRouteByHashes(w, r)
+	case StrategyMergeByHashes:
+		m.HandlerMergeByHashes(w, r)
+	case StrategyLeastBusy:
+		m.HandlerInstance(w, r, m.Pool.LeastBusy())
+	case StrategyPinned:
+		i := m.Pool.ByName(route.Instance)
+		if i == nil {
+			http.Error(w, "unknown instance: "+route.Instance, http.StatusNotFound)
+			return
+		}
+		m.HandlerInstance(w, r, i)
+	case StrategyReject:
+		log.Println("Rejected " + r.URL.Path)
+		http.Error(w, "rejected by multiplexer: "+r.URL.Path, http.StatusForbidden)
+	default:
+		if route.Path == "/api/v2/" {
+			log.Println("Passing through API call using Round Robin - consider adding a route for this case if appropriate")
+			log.Println(r.URL.String())
+		}
+		m.HandlerPassthrough(w, r)
+	}
+
+}
+
+// HandlerRouteByHash sends the request to the owner of the hash, or tries
+// every instance when the owner isn't known yet
+func (m *Multiplexer) HandlerRouteByHash(w http.ResponseWriter, r *http.Request) {
+	if i, ok := m.Pool.Owner(qbittorrent.Hash(r.Form.Get("hash"))); ok {
+		m.HandlerInstance(w, r, i)
+		return
+	}
+	m.HandlerTryAll(w, r, RequestOptions{
+		Callback: &RequestCallbackTryAllCacheHash,
+		Filter:   &RequestFilterOnHash,
+	})
+}
+
+// HandlerRouteByHashes splits the hashes field so every instance only gets
+// the hashes it owns. Unknown hashes go to every instance.
+func (m *Multiplexer) HandlerRouteByHashes(w http.ResponseWriter, r *http.Request) {
+	m.respondAll(w, m.sendAll(r, m.splitByHashes(r)))
+}
+
+// HandlerMergeByHashes splits the hashes field like HandlerRouteByHashes, for
+// getters answering with an object keyed by hash, so the answers are merged
+func (m *Multiplexer) HandlerMergeByHashes(w http.ResponseWriter, r *http.Request) {
+	requests := m.splitByHashes(r)
+	prepare := func(m *Multiplexer, i *qbittorrent.Instance, r *http.Request) *http.Request {
+		return requests[i]
+	}
+	resp, err := m.HandlerMergeJSON(r, RequestOptions{
+		Prepare: &prepare,
+	}, MergeOptions{
+		CollisionFn: &CollisionReplace,
+	})
+	m.MakeResponse(err, resp, w)
+}
+
+// splitByHashes gives every instance a copy of the request with only the
+// hashes it owns, or the request as is for every instance when it names all
+func (m *Multiplexer) splitByHashes(r *http.Request) map[*qbittorrent.Instance]*http.Request {
+
+	instances := m.Pool.Ready()
+	requests := map[*qbittorrent.Instance]*http.Request{}
+
+	hashes := r.Form.Get("hashes")
+	if hashes == "" || hashes == "all" {
+		for _, i := range instances {
+			requests[i] = r
+		}
+		return requests
+	}
+
+	split := map[*qbittorrent.Instance][]string{}
+
+	for _, hash := range strings.Split(hashes, "|") {
+		if i, ok := m.Pool.Owner(qbittorrent.Hash(hash)); ok {
+			split[i] = append(split[i], hash)
+		} else {
+			for _, i := range instances {
+				split[i] = append(split[i], hash)
+			}
+		}
+	}
+
+	for i, hashes := range split {
+		form := url.Values{}
+		for k, v := range r.Form {
+			form[k] = v
+		}
+		form.Set("hashes", strings.Join(hashes, "|"))
+		requests[i] = WithForm(r, form)
+	}
+
+	return requests
+
+}
+
+func (m *Multiplexer) HandlerBroadcast(w http.ResponseWriter, r *http.Request) {
+	requests := map[*qbittorrent.Instance]*http.Request{}
+	for _, i := range m.Pool.Ready() {
+		requests[i] = r
+	}
+	m.respondAll(w, m.sendAll(r, requests))
+}
+
+// sendAll sends each instance its own request in parallel
+func (m *Multiplexer) sendAll(r *http.Request, requests map[*qbittorrent.Instance]*http.Request) []Response {
+	prepare := func(m *Multiplexer, i *qbittorrent.Instance, r *http.Request) *http.Request {
+		return requests[i]
+	}
+	return m.ParallelResponses(r, RequestOptions{
+		Prepare: &prepare,
+	})
+}
+
+// respondAll answers with the first failure, or the first response when all succeeded
+func (m *Multiplexer) respondAll(w http.ResponseWriter, resps []Response) {
+
+	var chosen *Response
+	errs := []error{}
+
+	for n, resp := range resps {
+		if len(resp.errs) != 0 {
+			errs = append(errs, resp.errs...)
+			continue
+		}
+		if chosen == nil || (chosen.response.StatusCode == http.StatusOK && resp.response.StatusCode != http.StatusOK) {
+			chosen = &resps[n]
+		}
+	}
+
+	for _, resp := range resps {
+		if resp.response != nil && (chosen == nil || resp.response != chosen.response) {
+			io.Copy(io.Discard, resp.response.Body)
+			resp.response.Body.Close()
+		}
+	}
+
+	if len(errs) != 0 {
+		m.MakeResponse(errors.Join(errs...), nil, w)
+		return
+	}
+	if chosen == nil {
+		m.MakeResponse(errors.New("no instances"), nil, w)
+		return
+	}
+
+	m.MakeResponse(nil, chosen.response, w)
+
+}
+
+// WithForm returns a copy of the request carrying a different form, in the
+// body for POST requests and in the query otherwise
+func WithForm(r *http.Request, form url.Values) *http.Request {
+
+	newReq := r.Clone(r.Context())
+	newReq.Form = form
+	newReq.PostForm = nil
+
+	if r.Method == http.MethodPost {
+		body := form.Encode()
+		newReq.URL.RawQuery = ""
+		newReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		newReq.Header.Del("Content-Length")
+		newReq.ContentLength = int64(len(body))
+		newReq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(body)), nil
+		}
+		newReq.Body, _ = newReq.GetBody()
+	} else {
+		newReq.URL.RawQuery = form.Encode()
+	}
+
+	return newReq
+
+}
@@ -0,0 +1,159 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoutesMatch(t *testing.T) {
+
+	routes := DefaultRoutes.Merge(Routes{
+		{Path: "/api/v2/torrents/", Strategy: StrategyBroadcast},
+		{Path: "/api/v2/app/setPreferences", Strategy: StrategyPinned, Instance: "1"},
+	})
+
+	tests := []struct {
+		path string
+		want Strategy
+	}{
+		{"/", StrategyRoundRobin},
+		{"/index.html", StrategyRoundRobin},
+		{"/api/v2/app/version", StrategyRoundRobin},
+		{"/api/v2/sync/maindata", StrategyMaindata},
+		{"/api/v2/torrents/info", StrategyTorrentsInfo},         // Exact paths beat a prefix
+		{"/api/v2/torrents/unknownEndpoint", StrategyBroadcast}, // Longest prefix wins
+		{"/api/v2/app/setPreferences", StrategyPinned},
+		{"/api/v2/rss/items", StrategyRSS},
+		{"/api/v2/rss", StrategyRoundRobin}, // A prefix route needs its trailing /
+		{"/api/v2/search/plugins", StrategyMergeArray},
+		{"/api/v2/torrents/downloadLimit", StrategyMergeByHashes}, // Getters are merged
+		{"/api/v2/torrents/setDownloadLimit", StrategyRouteByHashes},
+	}
+
+	for _, test := range tests {
+		route := routes.Match(test.path)
+		if route == nil {
+			t.Errorf("%s: no route", test.path)
+		} else if route.Strategy != test.want {
+			t.Errorf("%s: got %s from %s, want %s", test.path, route.Strategy, route.Path, test.want)
+		}
+	}
+
+	if route := (Routes{{Path: "/api/v2/", Strategy: StrategyReject}}).Match("/other"); route != nil {
+		t.Errorf("/other: got %s, want no route", route.Path)
+	}
+
+}
+
+func TestRoutesMerge(t *testing.T) {
+
+	base := Routes{
+		{Path: "/a", Strategy: StrategyBroadcast},
+		{Path: "/b", Strategy: StrategyRoundRobin},
+	}
+
+	tests := []struct {
+		name      string
+		overrides Routes
+		want      Routes
+	}{
+		{
+			name: "none",
+			want: base,
+		},
+		{
+			name:      "replace keeps the position",
+			overrides: Routes{{Path: "/a", Strategy: StrategyReject}},
+			want:      Routes{{Path: "/a", Strategy: StrategyReject}, {Path: "/b", Strategy: StrategyRoundRobin}},
+		},
+		{
+			name:      "new paths are added",
+			overrides: Routes{{Path: "/c", Strategy: StrategyPinned, Instance: "x"}},
+			want:      Routes{{Path: "/a", Strategy: StrategyBroadcast}, {Path: "/b", Strategy: StrategyRoundRobin}, {Path: "/c", Strategy: StrategyPinned, Instance: "x"}},
+		},
+		{
+			name:      "a trailing / is another path",
+			overrides: Routes{{Path: "/a/", Strategy: StrategyReject}},
+			want:      Routes{{Path: "/a", Strategy: StrategyBroadcast}, {Path: "/b", Strategy: StrategyRoundRobin}, {Path: "/a/", Strategy: StrategyReject}},
+		},
+	}
+
+	for _, test := range tests {
+		merged := base.Merge(test.overrides)
+		if len(merged) != len(test.want) {
+			t.Errorf("%s: got %d routes, want %d", test.name, len(merged), len(test.want))
+			continue
+		}
+		for n := range merged {
+			if *merged[n] != *test.want[n] {
+				t.Errorf("%s: route %d is %+v, want %+v", test.name, n, *merged[n], *test.want[n])
+			}
+		}
+	}
+
+	// The defaults are left alone
+	if base[0].Strategy != StrategyBroadcast {
+		t.Error("Merge changed the routes it was called on")
+	}
+
+}
+
+func TestHandlerMergeByHashes(t *testing.T) {
+
+	limits := []map[string]int{{"a": 100, "c": 300}, {"b": 200}}
+
+	servers := []*httptest.Server{}
+	for n := range limits {
+		servers = append(servers, fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v2/torrents/downloadLimit" {
+				w.Write([]byte("[]"))
+				return
+			}
+			if r.FormValue("hashes") == "all" {
+				json.NewEncoder(w).Encode(limits[n])
+				return
+			}
+			// Unknown hashes are left out, like qBittorrent does
+			answer := map[string]int{}
+			for _, hash := range strings.Split(r.FormValue("hashes"), "|") {
+				if limit, ok := limits[n][hash]; ok {
+					answer[hash] = limit
+				}
+			}
+			json.NewEncoder(w).Encode(answer)
+		}))
+	}
+	m := newTestMultiplexer(t, Config{}, servers...)
+	a, b := m.Pool.All()[0], m.Pool.All()[1]
+	m.Pool.SetTorrent("a", a)
+	m.Pool.SetTorrent("b", b)
+
+	tests := []struct {
+		hashes string
+		want   map[string]int
+	}{
+		{"a|b", map[string]int{"a": 100, "b": 200}},
+		{"b", map[string]int{"b": 200}},
+		{"c", map[string]int{"c": 300}}, // Unknown owner, asked everywhere
+		{"all", map[string]int{"a": 100, "b": 200, "c": 300}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v2/torrents/downloadLimit?hashes="+test.hashes, nil)
+		m.ServeHTTP(w, r)
+		got := map[string]int{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: %v in %q", test.hashes, err, w.Body.String())
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.hashes, got, test.want)
+		}
+	}
+
+}
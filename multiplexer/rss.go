@@ -0,0 +1,636 @@
+package multiplexer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	RSSPinned      = "pinned"      // RSS endpoints go to a single instance
+	RSSMultiplexer = "multiplexer" // The multiplexer fetches feeds and places what the rules match
+
+	DefaultRSSInterval = 30 * time.Minute
+
+	// Articles kept per feed, like qBittorrent's default
+	RSSArticleLimit = 50
+)
+
+type RSSConfig struct {
+	Mode     string        `default:"pinned" usage:"Who runs RSS (pinned, multiplexer)"`
+	Instance string        `usage:"Instance name RSS is pinned to, the first configured one if empty"`
+	File     string        `usage:"File feeds and rules are kept in when the multiplexer runs RSS"`
+	Interval time.Duration `default:"30m" usage:"How often feeds are fetched when the multiplexer runs RSS"`
+}
+
+func (c RSSConfig) Validate() (errs []error) {
+	switch c.Mode {
+	case "", RSSPinned, RSSMultiplexer:
+	default:
+		errs = append(errs, errors.New("(RSS) Unknown Mode: "+c.Mode))
+	}
+	return
+}
+
+func (m *Multiplexer) validateRSS() (errs []error) {
+	if m.Config.RSS.Instance != "" && m.Pool.ByName(m.Config.RSS.Instance) == nil {
+		errs = append(errs, errors.New("(RSS) Unknown Instance: "+m.Config.RSS.Instance))
+	}
+	return
+}
+
+type RSSArticle struct {
+	ID          string `json:"id"`
+	Date        string `json:"date"`
+	Title       string `json:"title"`
+	TorrentURL  string `json:"torrentURL"`
+	Link        string `json:"link,omitempty"`
+	Description string `json:"description,omitempty"`
+	IsRead      bool   `json:"isRead"`
+}
+
+type RSSFeed struct {
+	UID           string       `json:"uid"`
+	URL           string       `json:"url"`
+	Title         string       `json:"title"`
+	LastBuildDate string       `json:"lastBuildDate"`
+	IsLoading     bool         `json:"isLoading"`
+	HasError      bool         `json:"hasError"`
+	Articles      []RSSArticle `json:"articles"`
+}
+
+// RSS holds the feeds, by path, and rules, by name, when the multiplexer runs RSS
+type RSS struct {
+	Feeds map[string]*RSSFeed `json:"feeds"`
+	Rules map[string]*RSSRule `json:"rules"`
+}
+
+// loadRSS reads the RSS file, a missing one is an empty start
+func (m *Multiplexer) loadRSS() error {
+
+	m.RSS = RSS{Feeds: map[string]*RSSFeed{}, Rules: map[string]*RSSRule{}}
+
+	if m.Config.RSS.File == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(m.Config.RSS.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.New("(RSS) " + err.Error())
+	}
+
+	err = json.Unmarshal(b, &m.RSS)
+	if err != nil {
+		return errors.New("(RSS) " + m.Config.RSS.File + ": " + err.Error())
+	}
+	if m.RSS.Feeds == nil {
+		m.RSS.Feeds = map[string]*RSSFeed{}
+	}
+	if m.RSS.Rules == nil {
+		m.RSS.Rules = map[string]*RSSRule{}
+	}
+	return nil
+
+}
+
+// saveRSS writes the RSS file, the lock must be held
+func (m *Multiplexer) saveRSS() {
+
+	if m.Config.RSS.File == "" {
+		return
+	}
+
+	b, err := json.MarshalIndent(m.RSS, "", "  ")
+	if err == nil {
+		// Written aside first, so a crash doesn't leave half a file
+		err = os.WriteFile(m.Config.RSS.File+".tmp", b, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(m.Config.RSS.File+".tmp", m.Config.RSS.File)
+	}
+	if err != nil {
+		log.Println("Saving RSS (" + m.Name + "): " + err.Error())
+	}
+
+}
+
+func newUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("{%x-%x-%x-%x-%x}", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// rssDocument reads both RSS 2.0 and Atom, the root element is ignored
+type rssDocument struct {
+	Channel struct {
+		Title         string `xml:"title"`
+		LastBuildDate string `xml:"lastBuildDate"`
+		Items         []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+			PubDate     string `xml:"pubDate"`
+			GUID        string `xml:"guid"`
+			Enclosure   struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Entries []struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Summary string `xml:"summary"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// fetchFeed downloads a feed, returning its title, build date and articles newest first
+func fetchFeed(feedURL string) (title, lastBuildDate string, articles []RSSArticle, err error) {
+
+	client := http.Client{Timeout: qbittorrent.DefaultTimeout}
+	resp, err := client.Get(feedURL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("Status Code: " + resp.Status)
+		return
+	}
+
+	doc := rssDocument{}
+	decoder := xml.NewDecoder(resp.Body)
+	// Feeds in other charsets are read as they are
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	err = decoder.Decode(&doc)
+	if err != nil {
+		return
+	}
+
+	title, lastBuildDate = doc.Channel.Title, doc.Channel.LastBuildDate
+	for _, item := range doc.Channel.Items {
+		article := RSSArticle{
+			ID:          item.GUID,
+			Date:        item.PubDate,
+			Title:       item.Title,
+			TorrentURL:  item.Enclosure.URL,
+			Link:        item.Link,
+			Description: item.Description,
+		}
+		if article.TorrentURL == "" {
+			article.TorrentURL = item.Link
+		}
+		articles = append(articles, article)
+	}
+
+	if len(doc.Entries) != 0 {
+		title, lastBuildDate = doc.Title, doc.Updated
+	}
+	for _, entry := range doc.Entries {
+		article := RSSArticle{
+			ID:          entry.ID,
+			Date:        entry.Updated,
+			Title:       entry.Title,
+			Description: entry.Summary,
+		}
+		for _, link := range entry.Links {
+			if link.Rel == "enclosure" || link.Type == "application/x-bittorrent" {
+				article.TorrentURL = link.Href
+			} else if article.Link == "" {
+				article.Link = link.Href
+			}
+		}
+		if article.TorrentURL == "" {
+			article.TorrentURL = article.Link
+		}
+		articles = append(articles, article)
+	}
+
+	for n := range articles {
+		if articles[n].ID == "" {
+			articles[n].ID = articles[n].Link
+		}
+		if articles[n].ID == "" {
+			articles[n].ID = articles[n].Title
+		}
+	}
+
+	return
+
+}
+
+func parseRSSDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", time.RFC3339} {
+		var t time.Time
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (m *Multiplexer) keepRefreshingRSS() {
+	interval := m.Config.RSS.Interval
+	if interval <= 0 {
+		interval = DefaultRSSInterval
+	}
+	for {
+		m.Locks.RSS.Lock()
+		paths := slices.Sorted(maps.Keys(m.RSS.Feeds))
+		m.Locks.RSS.Unlock()
+		for _, path := range paths {
+			if err := m.RefreshFeed(path); err != nil {
+				log.Println("Refreshing feed " + path + " (" + m.Name + "): " + err.Error())
+			}
+		}
+		if !m.wait(interval) {
+			return
+		}
+	}
+}
+
+// rssMatch is an article a rule picked, waiting to be placed
+type rssMatch struct {
+	Rule    string
+	Article RSSArticle
+	Options url.Values
+}
+
+// RefreshFeed fetches the feed at path, runs the rules over its unread
+// articles and places what they matched
+func (m *Multiplexer) RefreshFeed(path string) error {
+
+	m.Locks.RSS.Lock()
+	feed, ok := m.RSS.Feeds[path]
+	if !ok {
+		m.Locks.RSS.Unlock()
+		return errors.New("unknown feed: " + path)
+	}
+	feedURL := feed.URL
+	feed.IsLoading = true
+	m.Locks.RSS.Unlock()
+
+	title, lastBuildDate, articles, err := fetchFeed(feedURL)
+
+	m.Locks.RSS.Lock()
+
+	// The feed may have gone while it was fetched
+	feed, ok = m.RSS.Feeds[path]
+	if !ok {
+		m.Locks.RSS.Unlock()
+		return nil
+	}
+	feed.IsLoading = false
+	feed.HasError = err != nil
+	if err != nil {
+		m.Locks.RSS.Unlock()
+		return err
+	}
+
+	if title != "" {
+		feed.Title = title
+	}
+	feed.LastBuildDate = lastBuildDate
+
+	// Fetched articles first, keeping whether they were read, then the older ones still known
+	known := map[string]RSSArticle{}
+	for _, article := range feed.Articles {
+		known[article.ID] = article
+	}
+	merged := []RSSArticle{}
+	for _, article := range articles {
+		if old, ok := known[article.ID]; ok {
+			article.IsRead = old.IsRead
+			delete(known, article.ID)
+		}
+		merged = append(merged, article)
+	}
+	for _, article := range feed.Articles {
+		if _, ok := known[article.ID]; ok {
+			merged = append(merged, article)
+		}
+	}
+	if len(merged) > RSSArticleLimit {
+		merged = merged[:RSSArticleLimit]
+	}
+	feed.Articles = merged
+
+	matches := m.runRules(feed, time.Now())
+
+	m.saveRSS()
+	m.Locks.RSS.Unlock()
+
+	m.placeMatches(matches)
+
+	return nil
+
+}
+
+// runRules marks the articles the rules match as read and returns them, the lock must be held
+func (m *Multiplexer) runRules(feed *RSSFeed, now time.Time) (matches []rssMatch) {
+
+	for _, name := range slices.Sorted(maps.Keys(m.RSS.Rules)) {
+		rule := m.RSS.Rules[name]
+		if !slices.Contains(rule.AffectedFeeds, feed.URL) {
+			continue
+		}
+		for n := range feed.Articles {
+			article := &feed.Articles[n]
+			if article.IsRead || article.TorrentURL == "" {
+				continue
+			}
+			ok, episode := rule.Matches(article.Title, now)
+			if !ok {
+				continue
+			}
+			article.IsRead = true
+			rule.LastMatch = now.Format(time.RFC1123Z)
+			if rule.SmartFilter && episode != "" {
+				rule.PreviouslyMatchedEpisodes = append(rule.PreviouslyMatchedEpisodes, episode)
+			}
+			matches = append(matches, rssMatch{Rule: name, Article: *article, Options: rule.AddOptions()})
+		}
+	}
+
+	return
+
+}
+
+// placeMatches adds each match through the usual placement. Magnet hashes are
+// recorded straight away and other torrents counted as pending, so least busy
+// placement spreads a batch.
+func (m *Multiplexer) placeMatches(matches []rssMatch) {
+	pending := map[*qbittorrent.Instance]int{}
+	for _, match := range matches {
+		instance := m.placeAfter(pending)
+		if instance == nil {
+			log.Println("RSS rule " + match.Rule + " matched " + match.Article.Title + " but no instance is available")
+			continue
+		}
+		err := instance.AddURLs([]string{match.Article.TorrentURL}, match.Options)
+		if err != nil {
+			log.Println("RSS rule " + match.Rule + " adding " + match.Article.Title + " (" + instance.Host() + "): " + err.Error())
+			continue
+		}
+		log.Println("RSS rule " + match.Rule + " added " + match.Article.Title + " (" + instance.Host() + ")")
+		if hash := magnetHash(match.Article.TorrentURL); hash != "" {
+			m.Pool.SetTorrent(hash, instance)
+		} else {
+			pending[instance] += 1
+		}
+	}
+}
+
+// magnetHash returns the v1 info hash of a magnet link, empty for anything else
+func magnetHash(link string) qbittorrent.Hash {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "magnet" {
+		return ""
+	}
+	for _, xt := range u.Query()["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		if len(hash) == 32 {
+			b, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+			if err != nil {
+				continue
+			}
+			hash = hex.EncodeToString(b)
+		}
+		if len(hash) == 40 {
+			return qbittorrent.Hash(strings.ToLower(hash))
+		}
+	}
+	return ""
+}
+
+// HandlerRSS sends the rss endpoints to the pinned instance, or answers them
+// itself when the multiplexer runs RSS. Folders aren't supported there.
+func (m *Multiplexer) HandlerRSS(w http.ResponseWriter, r *http.Request) {
+
+	if m.Config.RSS.Mode != RSSMultiplexer {
+		instance := m.Pool.ByName(m.Config.RSS.Instance)
+		if m.Config.RSS.Instance == "" {
+			// The first configured instance, feeds don't move while it's down
+			if instances := m.Pool.All(); len(instances) != 0 {
+				instance = instances[0]
+			}
+		}
+		if instance == nil || !instance.Ready() {
+			http.Error(w, "RSS instance unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		m.HandlerInstance(w, r, instance)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/rss/")
+	var body interface{}
+	refresh := ""
+
+	m.Locks.RSS.Lock()
+
+	switch path {
+	case "addFeed":
+		feedURL, name := r.Form.Get("url"), r.Form.Get("path")
+		if name == "" {
+			name = feedURL
+		}
+		if feedURL == "" {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "missing feed URL", http.StatusBadRequest)
+			return
+		}
+		if _, ok := m.RSS.Feeds[name]; ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "feed already exists: "+name, http.StatusConflict)
+			return
+		}
+		m.RSS.Feeds[name] = &RSSFeed{UID: newUID(), URL: feedURL, Articles: []RSSArticle{}}
+		refresh = name
+
+	case "setFeedURL":
+		feed, ok := m.RSS.Feeds[r.Form.Get("path")]
+		if !ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "unknown feed: "+r.Form.Get("path"), http.StatusConflict)
+			return
+		}
+		feed.URL = r.Form.Get("url")
+		refresh = r.Form.Get("path")
+
+	case "removeItem":
+		if _, ok := m.RSS.Feeds[r.Form.Get("path")]; !ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "unknown feed: "+r.Form.Get("path"), http.StatusConflict)
+			return
+		}
+		delete(m.RSS.Feeds, r.Form.Get("path"))
+
+	case "moveItem":
+		from, to := r.Form.Get("itemPath"), r.Form.Get("destPath")
+		feed, ok := m.RSS.Feeds[from]
+		if _, exists := m.RSS.Feeds[to]; !ok || exists || to == "" {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "can't move "+from+" to "+to, http.StatusConflict)
+			return
+		}
+		delete(m.RSS.Feeds, from)
+		m.RSS.Feeds[to] = feed
+
+	case "items":
+		items := map[string]interface{}{}
+		withData := r.Form.Get("withData") == "true"
+		for name, feed := range m.RSS.Feeds {
+			if withData {
+				items[name] = feed
+			} else {
+				items[name] = map[string]string{"uid": feed.UID, "url": feed.URL}
+			}
+		}
+		body = items
+
+	case "markAsRead":
+		feed, ok := m.RSS.Feeds[r.Form.Get("itemPath")]
+		if !ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "unknown feed: "+r.Form.Get("itemPath"), http.StatusConflict)
+			return
+		}
+		for n := range feed.Articles {
+			if id := r.Form.Get("articleId"); id == "" || feed.Articles[n].ID == id {
+				feed.Articles[n].IsRead = true
+			}
+		}
+
+	case "refreshItem":
+		if _, ok := m.RSS.Feeds[r.Form.Get("itemPath")]; !ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "unknown feed: "+r.Form.Get("itemPath"), http.StatusConflict)
+			return
+		}
+		refresh = r.Form.Get("itemPath")
+
+	case "addFolder":
+		m.Locks.RSS.Unlock()
+		http.Error(w, "folders are not supported when the multiplexer runs RSS", http.StatusConflict)
+		return
+
+	case "setRule":
+		rule := &RSSRule{}
+		if err := json.Unmarshal([]byte(r.Form.Get("ruleDef")), rule); err != nil || r.Form.Get("ruleName") == "" {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "bad rule: "+r.Form.Get("ruleName"), http.StatusBadRequest)
+			return
+		}
+		m.RSS.Rules[r.Form.Get("ruleName")] = rule
+
+	case "renameRule":
+		from, to := r.Form.Get("ruleName"), r.Form.Get("newRuleName")
+		rule, ok := m.RSS.Rules[from]
+		if _, exists := m.RSS.Rules[to]; !ok || exists || to == "" {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "can't rename "+from+" to "+to, http.StatusConflict)
+			return
+		}
+		delete(m.RSS.Rules, from)
+		m.RSS.Rules[to] = rule
+
+	case "removeRule":
+		delete(m.RSS.Rules, r.Form.Get("ruleName"))
+
+	case "rules":
+		body = m.RSS.Rules
+
+	case "matchingArticles":
+		rule, ok := m.RSS.Rules[r.Form.Get("ruleName")]
+		if !ok {
+			m.Locks.RSS.Unlock()
+			http.Error(w, "unknown rule: "+r.Form.Get("ruleName"), http.StatusConflict)
+			return
+		}
+		// Everything the rule would take, whether read or not
+		preview := *rule
+		preview.Enabled = true
+		preview.IgnoreDays = 0
+		preview.SmartFilter = false
+		matching := map[string][]string{}
+		for name, feed := range m.RSS.Feeds {
+			if !slices.Contains(rule.AffectedFeeds, feed.URL) {
+				continue
+			}
+			for _, article := range feed.Articles {
+				if ok, _ := preview.Matches(article.Title, time.Now()); ok {
+					matching[name] = append(matching[name], article.Title)
+				}
+			}
+		}
+		body = matching
+
+	default:
+		m.Locks.RSS.Unlock()
+		http.Error(w, "unknown rss endpoint: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	var b []byte
+	var err error
+	if body != nil {
+		b, err = json.Marshal(body)
+	} else {
+		m.saveRSS()
+	}
+
+	m.Locks.RSS.Unlock()
+
+	if refresh != "" {
+		go func() {
+			if err := m.RefreshFeed(refresh); err != nil {
+				log.Println("Refreshing feed " + refresh + " (" + m.Name + "): " + err.Error())
+			}
+		}()
+	}
+
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}
+	if body != nil {
+		resp.Header = http.Header{"Content-Type": {"application/json"}}
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	m.MakeResponse(nil, resp, w)
+
+}
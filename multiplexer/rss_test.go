@@ -0,0 +1,52 @@
+package multiplexer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// rssInstance answers rss/items with its name, and can't connect while down
+func rssInstance(t *testing.T, name string, down *atomic.Bool) *httptest.Server {
+	return fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v2/rss/items":
+			io.WriteString(w, `{"`+name+`":{}}`)
+		default:
+			io.WriteString(w, "[]")
+		}
+	})
+}
+
+func TestHandlerRSSPinnedToFirst(t *testing.T) {
+
+	down := &atomic.Bool{}
+	down.Store(true)
+	m := newTestMultiplexer(t, Config{}, rssInstance(t, "first", down), rssInstance(t, "second", &atomic.Bool{}))
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v2/rss/items", nil))
+		return w
+	}
+
+	// Feeds don't move to the second instance while the first is down
+	if w := get(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d %q with the first instance down, want 503", w.Code, w.Body.String())
+	}
+
+	down.Store(false)
+	if err := m.Pool.Connect(m.Pool.ByName("0")); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != `{"first":{}}` {
+		t.Errorf("got %d %q, want the first instance's feeds", w.Code, w.Body.String())
+	}
+
+}
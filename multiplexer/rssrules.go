@@ -0,0 +1,207 @@
+package multiplexer
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RSSRule is a qBittorrent auto-download rule, v5 keeps the add options in
+// TorrentParams while older versions have their own fields
+type RSSRule struct {
+	Enabled                   bool                   `json:"enabled"`
+	MustContain               string                 `json:"mustContain"`
+	MustNotContain            string                 `json:"mustNotContain"`
+	UseRegex                  bool                   `json:"useRegex"`
+	EpisodeFilter             string                 `json:"episodeFilter"`
+	SmartFilter               bool                   `json:"smartFilter"`
+	PreviouslyMatchedEpisodes []string               `json:"previouslyMatchedEpisodes"`
+	AffectedFeeds             []string               `json:"affectedFeeds"`
+	IgnoreDays                int                    `json:"ignoreDays"`
+	LastMatch                 string                 `json:"lastMatch"`
+	AddPaused                 *bool                  `json:"addPaused"`
+	AssignedCategory          string                 `json:"assignedCategory"`
+	SavePath                  string                 `json:"savePath"`
+	TorrentParams             map[string]interface{} `json:"torrentParams,omitempty"`
+}
+
+// Episode numbers in titles, S01E02 or 1x02
+var episodePattern = regexp.MustCompile(`(?i)\b(?:s(\d{1,4})[ ._-]?e(\d{1,4})|(\d{1,4})x(\d{1,4}))\b`)
+
+// Matches reports whether an article title passes the rule, along with the
+// episode it is when the title has one
+func (rule *RSSRule) Matches(title string, now time.Time) (bool, string) {
+
+	if !rule.Enabled {
+		return false, ""
+	}
+
+	if rule.IgnoreDays > 0 && rule.LastMatch != "" {
+		if last, err := parseRSSDate(rule.LastMatch); err == nil && now.Sub(last) < time.Duration(rule.IgnoreDays)*24*time.Hour {
+			return false, ""
+		}
+	}
+
+	if rule.MustContain != "" && !rule.matchesExpression(title, rule.MustContain) {
+		return false, ""
+	}
+	if rule.MustNotContain != "" && rule.matchesExpression(title, rule.MustNotContain) {
+		return false, ""
+	}
+
+	episode := ""
+	season, number, ok := parseEpisode(title)
+	if ok {
+		episode = strconv.Itoa(season) + "x" + strconv.Itoa(number)
+	}
+
+	if rule.EpisodeFilter != "" && (!ok || !matchesEpisodeFilter(rule.EpisodeFilter, season, number)) {
+		return false, ""
+	}
+
+	if rule.SmartFilter && episode != "" && slices.Contains(rule.PreviouslyMatchedEpisodes, episode) {
+		return false, ""
+	}
+
+	return true, episode
+
+}
+
+// matchesExpression follows qBittorrent: a regular expression, or wildcards
+// where | separates alternatives and every word of an alternative must match
+func (rule *RSSRule) matchesExpression(title, expression string) bool {
+
+	if rule.UseRegex {
+		re, err := regexp.Compile("(?i)" + expression)
+		return err == nil && re.MatchString(title)
+	}
+
+	for _, alternative := range strings.Split(expression, "|") {
+		words := strings.Fields(alternative)
+		if len(words) == 0 {
+			continue
+		}
+		if !slices.ContainsFunc(words, func(word string) bool { return !matchesWildcard(title, word) }) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// matchesWildcard finds the word anywhere in the title, with * and ? as wildcards
+func matchesWildcard(title, word string) bool {
+	pattern := regexp.QuoteMeta(word)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	re, err := regexp.Compile("(?i)" + pattern)
+	return err == nil && re.MatchString(title)
+}
+
+func parseEpisode(title string) (season, episode int, ok bool) {
+	match := episodePattern.FindStringSubmatch(title)
+	if match == nil {
+		return 0, 0, false
+	}
+	if match[1] == "" {
+		match[1], match[2] = match[3], match[4]
+	}
+	season, _ = strconv.Atoi(match[1])
+	episode, _ = strconv.Atoi(match[2])
+	return season, episode, true
+}
+
+// matchesEpisodeFilter reads filters like 1x2;5-7;10-; where an open range
+// also takes in every later season
+func matchesEpisodeFilter(filter string, season, episode int) bool {
+
+	seasonPart, ranges, ok := strings.Cut(filter, "x")
+	if !ok {
+		return false
+	}
+	filterSeason, err := strconv.Atoi(strings.TrimSpace(seasonPart))
+	if err != nil {
+		return false
+	}
+
+	for _, r := range strings.Split(ranges, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(r, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			continue
+		}
+		switch {
+		case !isRange:
+			if season == filterSeason && episode == first {
+				return true
+			}
+		case to == "":
+			if season > filterSeason || (season == filterSeason && episode >= first) {
+				return true
+			}
+		default:
+			last, err := strconv.Atoi(to)
+			if err == nil && season == filterSeason && episode >= first && episode <= last {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+// AddOptions are the torrents/add fields for torrents the rule matched
+func (rule *RSSRule) AddOptions() url.Values {
+
+	options := url.Values{}
+
+	category := rule.AssignedCategory
+	savePath := rule.SavePath
+	paused := rule.AddPaused
+
+	if params := rule.TorrentParams; params != nil {
+		if v, ok := params["category"].(string); ok && v != "" {
+			category = v
+		}
+		if v, ok := params["save_path"].(string); ok && v != "" {
+			savePath = v
+		}
+		if v, ok := params["stopped"].(bool); ok {
+			paused = &v
+		}
+		if tags, ok := params["tags"].([]interface{}); ok {
+			names := []string{}
+			for _, tag := range tags {
+				if name, ok := tag.(string); ok {
+					names = append(names, name)
+				}
+			}
+			if len(names) != 0 {
+				options.Set("tags", strings.Join(names, ","))
+			}
+		}
+	}
+
+	if category != "" {
+		options.Set("category", category)
+	}
+	if savePath != "" {
+		options.Set("savepath", savePath)
+	}
+	if paused != nil {
+		// v5 renamed paused to stopped
+		options.Set("paused", strconv.FormatBool(*paused))
+		options.Set("stopped", strconv.FormatBool(*paused))
+	}
+
+	return options
+
+}
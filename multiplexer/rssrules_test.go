@@ -0,0 +1,101 @@
+package multiplexer
+
+import (
+	"testing"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+func TestMatchesEpisodeFilter(t *testing.T) {
+
+	tests := []struct {
+		filter          string
+		season, episode int
+		want            bool
+	}{
+		{"1x2;", 1, 2, true},
+		{"1x2;", 1, 3, false},
+		{"1x2;", 2, 2, false}, // Another season
+		{"1x5-7;", 1, 5, true},
+		{"1x5-7;", 1, 7, true},
+		{"1x5-7;", 1, 8, false},
+		{"1x2;5-7;", 1, 6, true},
+		{"1x10-;", 1, 9, false},
+		{"1x10-;", 1, 10, true},
+		{"1x10-;", 2, 1, true}, // An open range takes in later seasons
+		{"2x10-;", 1, 20, false},
+		{" 1 x 2 ; ", 1, 2, true},
+		{"12;", 1, 2, false}, // No x
+		{"ax2;", 1, 2, false},
+		{"1xb;2;", 1, 2, true}, // Bad parts are skipped
+		{"1x", 1, 2, false},
+	}
+
+	for _, test := range tests {
+		if got := matchesEpisodeFilter(test.filter, test.season, test.episode); got != test.want {
+			t.Errorf("%q with S%dE%d: got %v, want %v", test.filter, test.season, test.episode, got, test.want)
+		}
+	}
+
+}
+
+func TestMatchesExpression(t *testing.T) {
+
+	tests := []struct {
+		expression string
+		regex      bool
+		title      string
+		want       bool
+	}{
+		{"show 1080p", false, "The.Show.S01E02.1080p.WEB", true},
+		{"show 1080p", false, "The.Show.S01E02.720p.WEB", false}, // Every word has to match
+		{"SHOW", false, "the show", true},
+		{"s01e0?", false, "Show S01E05", true},
+		{"show*web", false, "Show.S01.WEB", true},
+		{"show*web", false, "Show.S01.HDTV", false},
+		{"other|show", false, "The Show", true},
+		{"other|another", false, "The Show", false},
+		{"| |show", false, "The Show", true}, // Empty alternatives are skipped
+		{"", false, "The Show", false},
+		{"a.b", false, "axb", false}, // No regular expressions without regex
+		{`^the show s\d+`, true, "The Show S01E02", true},
+		{`^show`, true, "The Show", false},
+		{`show (`, true, "The Show (", false}, // Doesn't compile
+	}
+
+	for _, test := range tests {
+		rule := &RSSRule{UseRegex: test.regex}
+		if got := rule.matchesExpression(test.title, test.expression); got != test.want {
+			t.Errorf("%q (regex %v) on %q: got %v, want %v", test.expression, test.regex, test.title, got, test.want)
+		}
+	}
+
+}
+
+func TestMagnetHash(t *testing.T) {
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		link string
+		want qbittorrent.Hash
+	}{
+		{"magnet:?xt=urn:btih:" + hash + "&dn=name", hash},
+		{"magnet:?xt=urn:btih:0123456789ABCDEF0123456789ABCDEF01234567", hash},
+		{"magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH", hash},
+		{"magnet:?xt=urn:btih:aeruKZ4JVPG66AJDIVTYTK6N54ASGRLH", hash},
+		{"magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:" + hash, hash},
+		{"magnet:?xt=urn:btmh:1220abcd", ""}, // v2 only
+		{"magnet:?dn=name", ""},
+		{"magnet:?xt=urn:btih:0123", ""},
+		{"https://example.com/" + hash + ".torrent", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := magnetHash(test.link); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.link, got, test.want)
+		}
+	}
+
+}
@@ -0,0 +1,333 @@
+package multiplexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+const (
+	SearchPinned = "pinned" // Each search runs on a single instance
+	SearchAll    = "all"    // Each search runs on every instance, results merged
+)
+
+type SearchConfig struct {
+	Mode string `default:"pinned" usage:"Where searches run (pinned, all)"`
+}
+
+func (c SearchConfig) Validate() (errs []error) {
+	switch c.Mode {
+	case "", SearchPinned, SearchAll:
+	default:
+		errs = append(errs, errors.New("(Search) Unknown Mode: "+c.Mode))
+	}
+	return
+}
+
+// Search is a search job of the multiplexer, made of one job per instance it runs on
+type Search struct {
+	ID   int64
+	Jobs map[*qbittorrent.Instance]int64
+
+	// Results only ever get appended, so offsets hold between polls
+	results []qbittorrent.SearchResult
+	read    map[*qbittorrent.Instance]int // Results taken from each job so far
+	seen    map[string]bool
+	mutex   sync.Mutex
+}
+
+type Searches struct {
+	Jobs   map[int64]*Search
+	NextID int64 // Starts at 1, clients can take 0 for no job
+}
+
+// each calls fn for every job of the search in parallel, errors are tagged with the instance
+func (s *Search) each(fn func(instance *qbittorrent.Instance, id int64) error) error {
+
+	instances := slices.Collect(maps.Keys(s.Jobs))
+
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) error {
+		if err := fn(instance, s.Jobs[instance]); err != nil {
+			return errors.New("(" + instance.Host() + ") " + err.Error())
+		}
+		return nil
+	})
+
+	return errors.Join(errs...)
+
+}
+
+// search returns the search with the id form field
+func (m *Multiplexer) search(r *http.Request) (*Search, error) {
+
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("bad id: " + r.Form.Get("id"))
+	}
+
+	m.Locks.Searches.Lock()
+	defer m.Locks.Searches.Unlock()
+
+	s, ok := m.Searches.Jobs[id]
+	if !ok {
+		return nil, qbittorrent.ErrNotFound
+	}
+	return s, nil
+
+}
+
+// StartSearch starts a job on one ready instance, or on all of them in the all mode
+func (m *Multiplexer) StartSearch(pattern, plugins, category string) (*Search, error) {
+
+	instances := m.Pool.Ready()
+	if m.Config.Search.Mode != SearchAll {
+		instances = []*qbittorrent.Instance{m.Pool.NextRoundRobin()}
+	}
+	if len(instances) == 0 || instances[0] == nil {
+		return nil, errors.New("no instance available")
+	}
+
+	ids := make([]int64, len(instances))
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) (err error) {
+		ids[n], err = instance.SearchStart(pattern, plugins, category)
+		return
+	})
+
+	s := &Search{
+		Jobs:    map[*qbittorrent.Instance]int64{},
+		results: []qbittorrent.SearchResult{},
+		read:    map[*qbittorrent.Instance]int{},
+		seen:    map[string]bool{},
+	}
+	for n, instance := range instances {
+		if errs[n] != nil {
+			log.Println("Starting search (" + instance.Host() + "): " + errs[n].Error())
+			continue
+		}
+		s.Jobs[instance] = ids[n]
+	}
+
+	// A search missing some instances still finds something
+	if len(s.Jobs) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	m.Locks.Searches.Lock()
+	s.ID = m.Searches.NextID
+	m.Searches.NextID += 1
+	m.Searches.Jobs[s.ID] = s
+	m.Locks.Searches.Unlock()
+
+	return s, nil
+
+}
+
+// searchStatus reads what the jobs found since the last poll, so the total is
+// the same deduplicated one search/results reports, running while any job is
+func (m *Multiplexer) searchStatus(s *Search) qbittorrent.SearchStatus {
+
+	status := qbittorrent.SearchStatus{ID: s.ID, Status: qbittorrent.SearchStopped}
+
+	results, err := m.searchResults(s)
+	if err != nil {
+		log.Println("Search status (" + strconv.FormatInt(s.ID, 10) + "): " + err.Error())
+		s.mutex.Lock()
+		status.Total = int64(len(s.results))
+		s.mutex.Unlock()
+		return status
+	}
+
+	status.Status = results.Status
+	status.Total = results.Total
+	return status
+
+}
+
+// searchResults adds what each job found since the last poll to the end of
+// the merged results, the same file found by several instances is only listed once
+func (m *Multiplexer) searchResults(s *Search) (*qbittorrent.SearchResults, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instances := []*qbittorrent.Instance{}
+	for _, instance := range m.Pool.All() {
+		if _, ok := s.Jobs[instance]; ok {
+			instances = append(instances, instance)
+		}
+	}
+
+	fetched := make([]*qbittorrent.SearchResults, len(instances))
+	errs := ParallelCalls(instances, func(n int, instance *qbittorrent.Instance) (err error) {
+		fetched[n], err = instance.SearchResults(s.Jobs[instance], s.read[instance])
+		return
+	})
+
+	status := qbittorrent.SearchStopped
+	ok := false
+
+	for n, instance := range instances {
+		if errs[n] != nil {
+			log.Println("Search results (" + instance.Host() + "): " + errs[n].Error())
+			continue
+		}
+		ok = true
+		if fetched[n].Status == qbittorrent.SearchRunning {
+			status = qbittorrent.SearchRunning
+		}
+		s.read[instance] += len(fetched[n].Results)
+		for _, result := range fetched[n].Results {
+			key, _ := result["fileUrl"].(string)
+			if key == "" {
+				key, _ = result["descrLink"].(string)
+			}
+			if key != "" && s.seen[key] {
+				continue
+			}
+			s.seen[key] = true
+			s.results = append(s.results, result)
+		}
+	}
+
+	if !ok {
+		return nil, errors.Join(errs...)
+	}
+
+	return &qbittorrent.SearchResults{
+		Results: slices.Clip(s.results),
+		Status:  status,
+		Total:   int64(len(s.results)),
+	}, nil
+
+}
+
+// HandlerSearch answers search/start, status, results, stop and delete with
+// multiplexer job ids, mapped onto the jobs of the instances
+func (m *Multiplexer) HandlerSearch(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/search/")
+
+	var body interface{}
+
+	switch path {
+	case "start":
+		s, err := m.StartSearch(r.Form.Get("pattern"), r.Form.Get("plugins"), r.Form.Get("category"))
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		log.Println("Search " + strconv.FormatInt(s.ID, 10) + " started on " + strconv.Itoa(len(s.Jobs)) + " instances (" + m.Name + ")")
+		body = map[string]int64{"id": s.ID}
+
+	case "status":
+		searches := []*Search{}
+		if r.Form.Get("id") != "" {
+			s, err := m.search(r)
+			if err != nil {
+				m.searchError(w, err)
+				return
+			}
+			searches = append(searches, s)
+		} else {
+			m.Locks.Searches.Lock()
+			for _, id := range slices.Sorted(maps.Keys(m.Searches.Jobs)) {
+				searches = append(searches, m.Searches.Jobs[id])
+			}
+			m.Locks.Searches.Unlock()
+		}
+		statuses := make([]qbittorrent.SearchStatus, len(searches))
+		for n, s := range searches {
+			statuses[n] = m.searchStatus(s)
+		}
+		body = statuses
+
+	case "results":
+		s, err := m.search(r)
+		if err != nil {
+			m.searchError(w, err)
+			return
+		}
+		results, err := m.searchResults(s)
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		// Same paging as qBittorrent, a negative offset counts from the end
+		offset, _ := strconv.Atoi(r.Form.Get("offset"))
+		limit, _ := strconv.Atoi(r.Form.Get("limit"))
+		if offset < 0 {
+			offset = max(len(results.Results)+offset, 0)
+		}
+		if offset > len(results.Results) {
+			http.Error(w, "offset out of range", http.StatusConflict)
+			return
+		}
+		results.Results = results.Results[offset:]
+		if limit > 0 && limit < len(results.Results) {
+			results.Results = results.Results[:limit]
+		}
+		body = results
+
+	case "stop", "delete":
+		s, err := m.search(r)
+		if err != nil {
+			m.searchError(w, err)
+			return
+		}
+		err = s.each(func(instance *qbittorrent.Instance, id int64) error {
+			if path == "stop" {
+				return instance.SearchStop(id)
+			}
+			return instance.SearchDelete(id)
+		})
+		if path == "delete" {
+			// Jobs that failed to delete are gone from the instances' point of view anyway
+			m.Locks.Searches.Lock()
+			delete(m.Searches.Jobs, s.ID)
+			m.Locks.Searches.Unlock()
+		}
+		if err != nil {
+			m.MakeResponse(err, nil, w)
+			return
+		}
+		m.MakeResponse(nil, &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, w)
+		return
+
+	default:
+		http.Error(w, "unknown search endpoint: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		m.MakeResponse(err, nil, w)
+		return
+	}
+
+	m.MakeResponse(nil, &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(b)),
+		Request:    r,
+	}, w)
+
+}
+
+// searchError answers like qBittorrent does for a bad or unknown job id
+func (m *Multiplexer) searchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, qbittorrent.ErrNotFound) {
+		http.Error(w, "unknown search id", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,76 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// searchInstance runs job 0, qBittorrent's first id, and finds the files
+func searchInstance(t *testing.T, files ...string) *httptest.Server {
+	return fakeInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/search/start":
+			io.WriteString(w, `{"id":0}`)
+		case "/api/v2/search/status":
+			json.NewEncoder(w).Encode([]qbittorrent.SearchStatus{{ID: 0, Status: qbittorrent.SearchStopped, Total: int64(len(files))}})
+		case "/api/v2/search/results":
+			offset, _ := strconv.Atoi(r.FormValue("offset"))
+			results := []qbittorrent.SearchResult{}
+			for _, file := range files[offset:] {
+				results = append(results, qbittorrent.SearchResult{"fileName": file, "fileUrl": "https://example.com/" + file})
+			}
+			json.NewEncoder(w).Encode(qbittorrent.SearchResults{Results: results, Status: qbittorrent.SearchStopped, Total: int64(len(files))})
+		default:
+			io.WriteString(w, "[]")
+		}
+	})
+}
+
+func TestHandlerSearch(t *testing.T) {
+
+	m := newTestMultiplexer(t, Config{Search: SearchConfig{Mode: SearchAll}},
+		searchInstance(t, "a", "b"), searchInstance(t, "b", "c"))
+
+	call := func(path string, v interface{}) {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v2/search/"+path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %q", path, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	started := map[string]int64{}
+	call("start?pattern=debian&plugins=all&category=all", &started)
+	id := started["id"]
+	if id == 0 {
+		t.Fatal("got search id 0")
+	}
+
+	statuses := []qbittorrent.SearchStatus{}
+	call("status?id="+strconv.FormatInt(id, 10), &statuses)
+	results := qbittorrent.SearchResults{}
+	call("results?id="+strconv.FormatInt(id, 10), &results)
+
+	if len(results.Results) != 3 || results.Total != 3 {
+		t.Errorf("got %d results and a total of %d, want the 3 files once", len(results.Results), results.Total)
+	}
+	if len(statuses) != 1 || statuses[0].ID != id || statuses[0].Total != results.Total {
+		t.Errorf("status is %+v, want the total of the results, %d", statuses, results.Total)
+	}
+
+	// Every status has an id too
+	call("status", &statuses)
+	if len(statuses) != 1 || statuses[0].ID != id {
+		t.Errorf("statuses are %+v", statuses)
+	}
+
+}
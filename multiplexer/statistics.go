@@ -0,0 +1,225 @@
+package multiplexer
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+type StatisticsMethod string
+
+const (
+	StatisticsMethodSum         = StatisticsMethod("sum")          // Added up
+	StatisticsMethodAverage     = StatisticsMethod("avg")          // Mean of the instances reporting it
+	StatisticsMethodMin         = StatisticsMethod("min")          // Lowest value
+	StatisticsMethodMax         = StatisticsMethod("max")          // Highest value
+	StatisticsMethodWorstStatus = StatisticsMethod("worst-status") // disconnected, then firewalled, then connected
+	StatisticsMethodAny         = StatisticsMethod("any")          // True if any instance is true
+	StatisticsMethodAll         = StatisticsMethod("all")          // True if every instance is true
+	StatisticsMethodPerInstance = StatisticsMethod("per-instance") // Object of instance name to value
+	StatisticsMethodRatio       = StatisticsMethod("ratio")        // Total alltime_ul over total alltime_dl
+	StatisticsMethodLimit       = StatisticsMethod("limit")        // Added up, unless any is unlimited (0)
+)
+
+var StatisticsMethods = []StatisticsMethod{
+	StatisticsMethodSum,
+	StatisticsMethodAverage,
+	StatisticsMethodMin,
+	StatisticsMethodMax,
+	StatisticsMethodWorstStatus,
+	StatisticsMethodAny,
+	StatisticsMethodAll,
+	StatisticsMethodPerInstance,
+	StatisticsMethodRatio,
+	StatisticsMethodLimit,
+}
+
+// Statistics maps server_state keys to how they are combined, other keys keep
+// the value of whichever instance merged last
+type Statistics map[string]StatisticsMethod
+
+var DefaultStatistics = Statistics{
+	"alltime_dl":             StatisticsMethodSum,
+	"alltime_ul":             StatisticsMethodSum,
+	"dht_nodes":              StatisticsMethodSum,
+	"dl_info_data":           StatisticsMethodSum,
+	"dl_info_speed":          StatisticsMethodSum,
+	"dl_rate_limit":          StatisticsMethodLimit,
+	"up_info_data":           StatisticsMethodSum,
+	"up_info_speed":          StatisticsMethodSum,
+	"up_rate_limit":          StatisticsMethodLimit,
+	"total_peer_connections": StatisticsMethodSum,
+	"total_buffers_size":     StatisticsMethodSum,
+	"total_queued_size":      StatisticsMethodSum,
+	"free_space_on_disk":     StatisticsMethodMin, // Instances often share a disk
+	"connection_status":      StatisticsMethodWorstStatus,
+	"use_alt_speed_limits":   StatisticsMethodAny,
+	"queueing":               StatisticsMethodAny,
+	"global_ratio":           StatisticsMethodRatio,
+	"average_time_queue":     StatisticsMethodAverage,
+	"read_cache_hits":        StatisticsMethodAverage,
+	"write_cache_overload":   StatisticsMethodAverage,
+	"refresh_interval":       StatisticsMethodMax,
+}
+
+var connectionStatuses = []string{"disconnected", "firewalled", "connected"}
+
+// Merge returns a copy of the statistics with the other entries replacing or adding to them
+func (s Statistics) Merge(other Statistics) Statistics {
+	merged := Statistics{}
+	for key, method := range s {
+		merged[key] = method
+	}
+	for key, method := range other {
+		merged[key] = method
+	}
+	return merged
+}
+
+func (s Statistics) Validate() (errs []error) {
+	for key, method := range s {
+		if !slices.Contains(StatisticsMethods, method) {
+			errs = append(errs, errors.New("(Statistics) Unknown Method for "+key+": "+string(method)))
+		}
+	}
+	return
+}
+
+// Aggregate combines the last known values of each instance, keyed by
+// server_state key. Keys no instance has reported are left out.
+func (s Statistics) Aggregate(instances []*qbittorrent.Instance, values map[*qbittorrent.Instance]map[string]interface{}) map[string]interface{} {
+
+	result := map[string]interface{}{}
+
+	for key, method := range s {
+
+		reported := []*qbittorrent.Instance{}
+		for _, instance := range instances {
+			if _, ok := values[instance][key]; ok {
+				reported = append(reported, instance)
+			}
+		}
+
+		if len(reported) == 0 {
+			continue
+		}
+
+		switch method {
+
+		case StatisticsMethodPerInstance:
+			perInstance := map[string]interface{}{}
+			for _, instance := range reported {
+				name := instance.Name
+				if name == "" {
+					name = instance.Host()
+				}
+				perInstance[name] = values[instance][key]
+			}
+			result[key] = perInstance
+
+		case StatisticsMethodWorstStatus:
+			worst := len(connectionStatuses) - 1
+			for _, instance := range reported {
+				status, _ := values[instance][key].(string)
+				// Anything unknown counts as the worst
+				worst = min(worst, max(slices.Index(connectionStatuses, status), 0))
+			}
+			result[key] = connectionStatuses[worst]
+
+		case StatisticsMethodAny, StatisticsMethodAll:
+			value := method == StatisticsMethodAll
+			for _, instance := range reported {
+				b, _ := values[instance][key].(bool)
+				if method == StatisticsMethodAny {
+					value = value || b
+				} else {
+					value = value && b
+				}
+			}
+			result[key] = value
+
+		case StatisticsMethodRatio:
+			ul, dl := 0.0, 0.0
+			for _, instance := range reported {
+				v, _ := toFloat(values[instance]["alltime_ul"])
+				ul += v
+				v, _ = toFloat(values[instance]["alltime_dl"])
+				dl += v
+			}
+			ratio := 0.0
+			if dl > 0 {
+				ratio = ul / dl
+			}
+			// qBittorrent sends the ratio as a string
+			result[key] = strconv.FormatFloat(ratio, 'f', 2, 64)
+
+		default:
+			numbers := []float64{}
+			isString := false
+			for _, instance := range reported {
+				v, ok := toFloat(values[instance][key])
+				if ok {
+					numbers = append(numbers, v)
+				}
+				_, s := values[instance][key].(string)
+				isString = isString || s
+			}
+			if len(numbers) == 0 {
+				continue
+			}
+
+			value := 0.0
+			switch method {
+			case StatisticsMethodSum, StatisticsMethodAverage:
+				for _, v := range numbers {
+					value += v
+				}
+				if method == StatisticsMethodAverage {
+					value = value / float64(len(numbers))
+				}
+			case StatisticsMethodLimit:
+				for _, v := range numbers {
+					if v <= 0 {
+						value = 0
+						break
+					}
+					value += v
+				}
+			case StatisticsMethodMin:
+				value = slices.Min(numbers)
+			case StatisticsMethodMax:
+				value = slices.Max(numbers)
+			}
+
+			// Keep numbers sent as strings (cache percentages) as strings
+			if isString {
+				result[key] = strconv.FormatFloat(value, 'f', 2, 64)
+			} else {
+				result[key] = value
+			}
+
+		}
+
+	}
+
+	return result
+
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
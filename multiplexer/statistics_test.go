@@ -0,0 +1,61 @@
+package multiplexer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+func TestStatisticsAggregate(t *testing.T) {
+
+	a, b, c := &qbittorrent.Instance{Name: "a"}, &qbittorrent.Instance{Name: "b"}, &qbittorrent.Instance{Name: "c"}
+	instances := []*qbittorrent.Instance{a, b, c}
+
+	tests := []struct {
+		name   string
+		method StatisticsMethod
+		values []interface{} // Per instance, nil when it didn't report the key
+		want   interface{}   // nil when the key is left out
+	}{
+		{"limit adds up", StatisticsMethodLimit, []interface{}{100.0, 200.0, 300.0}, 600.0},
+		{"limit unlimited if any is", StatisticsMethodLimit, []interface{}{100.0, 0.0, 300.0}, 0.0},
+		{"limit unlimited if any is negative", StatisticsMethodLimit, []interface{}{-1.0, 200.0, 300.0}, 0.0},
+		{"limit ignores instances not reporting", StatisticsMethodLimit, []interface{}{100.0, nil, 300.0}, 400.0},
+		{"worst status connected", StatisticsMethodWorstStatus, []interface{}{"connected", "connected", "connected"}, "connected"},
+		{"worst status firewalled", StatisticsMethodWorstStatus, []interface{}{"connected", "firewalled", "connected"}, "firewalled"},
+		{"worst status disconnected", StatisticsMethodWorstStatus, []interface{}{"firewalled", "connected", "disconnected"}, "disconnected"},
+		{"worst status unknown counts as worst", StatisticsMethodWorstStatus, []interface{}{"connected", "sleeping", "connected"}, "disconnected"},
+		{"worst status ignores instances not reporting", StatisticsMethodWorstStatus, []interface{}{nil, "firewalled", nil}, "firewalled"},
+		{"nobody reporting", StatisticsMethodWorstStatus, []interface{}{nil, nil, nil}, nil},
+		{"sum", StatisticsMethodSum, []interface{}{1.0, 2.0, 3.0}, 6.0},
+		{"average of reporting instances", StatisticsMethodAverage, []interface{}{"10", nil, "20"}, "15.00"},
+		{"any", StatisticsMethodAny, []interface{}{false, true, false}, true},
+		{"all", StatisticsMethodAll, []interface{}{true, false, true}, false},
+		{"per instance", StatisticsMethodPerInstance, []interface{}{1.0, nil, 3.0}, map[string]interface{}{"a": 1.0, "c": 3.0}},
+	}
+
+	for _, test := range tests {
+		values := map[*qbittorrent.Instance]map[string]interface{}{}
+		for n, value := range test.values {
+			values[instances[n]] = map[string]interface{}{}
+			if value != nil {
+				values[instances[n]]["key"] = value
+			}
+		}
+
+		result := Statistics{"key": test.method}.Aggregate(instances, values)
+
+		got, ok := result["key"]
+		if test.want == nil {
+			if ok {
+				t.Errorf("%s: got %v, want the key left out", test.name, got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+
+}
@@ -0,0 +1,409 @@
+package multiplexer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+// The torrents/info merge never builds the full list in memory. Each upstream
+// body is decoded one torrent at a time, ownership and RemoveFields are
+// handled in that same pass, and the sorted upstream lists are merged straight
+// into the ResponseWriter.
+
+type jsonField struct {
+	key   string
+	value json.RawMessage
+	omit  bool
+}
+
+type torrentStream struct {
+	instance *qbittorrent.Instance
+	dec      *json.Decoder
+
+	// Current element, field buffers are reused between elements
+	fields  []jsonField
+	sortIdx int
+
+	hashes []qbittorrent.Hash
+}
+
+// ErrStreamCut is returned once part of the merged list was written, the
+// response can then only be aborted
+var ErrStreamCut = errors.New("torrents/info stream cut short")
+
+// countingWriter tells whether anything reached the client yet
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Upstream filters that mean the response is not the full torrent list
+var torrentsInfoPartialKeys = []string{"filter", "category", "tag", "hashes", "limit", "offset"}
+
+func newTorrentStream(instance *qbittorrent.Instance, body io.Reader) (*torrentStream, error) {
+	s := &torrentStream{
+		instance: instance,
+		dec:      json.NewDecoder(body),
+	}
+	tok, err := s.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, errors.New("(" + instance.Host() + ") torrents/info did not return an array")
+	}
+	return s, nil
+}
+
+// next decodes the following torrent, returning false once the array is exhausted
+func (s *torrentStream) next(sortKey string, remove map[string]bool) (bool, error) {
+
+	if !s.dec.More() {
+		return false, nil
+	}
+
+	tok, err := s.dec.Token()
+	if err != nil {
+		return false, err
+	}
+	if tok != json.Delim('{') {
+		return false, errors.New("(" + s.instance.Host() + ") torrents/info entry is not an object")
+	}
+
+	s.fields = s.fields[:0]
+	s.sortIdx = -1
+	var hash qbittorrent.Hash
+
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return false, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return false, errors.New("(" + s.instance.Host() + ") unexpected token in torrents/info entry")
+		}
+
+		n := len(s.fields)
+		if n < cap(s.fields) {
+			s.fields = s.fields[:n+1]
+		} else {
+			s.fields = append(s.fields, jsonField{})
+		}
+		field := &s.fields[n]
+		field.key = key
+		field.omit = remove[key]
+
+		// RawMessage reuses its backing array when decoded into
+		if err := s.dec.Decode(&field.value); err != nil {
+			return false, err
+		}
+
+		if key == "hash" && len(field.value) > 2 {
+			hash = qbittorrent.Hash(field.value[1 : len(field.value)-1])
+		}
+		if key == sortKey {
+			s.sortIdx = n
+		}
+	}
+
+	if _, err := s.dec.Token(); err != nil {
+		return false, err
+	}
+
+	if hash == "" {
+		return false, errors.New("(" + s.instance.Host() + ") no hash found for torrent")
+	}
+	s.hashes = append(s.hashes, hash)
+
+	return true, nil
+}
+
+func (s *torrentStream) sortValue() json.RawMessage {
+	if s.sortIdx < 0 {
+		return nil
+	}
+	return s.fields[s.sortIdx].value
+}
+
+// Numbers compare numerically, strings unescaped by UTF-16 code units the way
+// qBittorrent sorts its QStrings, everything else by its raw bytes
+func compareJSON(a, b json.RawMessage) int {
+	if len(a) > 1 && len(b) > 1 && a[0] == '"' && b[0] == '"' {
+		return compareUTF16(unquoteJSON(a), unquoteJSON(b))
+	}
+	if len(a) > 0 && len(b) > 0 && a[0] != '"' && b[0] != '"' {
+		af, errA := strconv.ParseFloat(string(a), 64)
+		bf, errB := strconv.ParseFloat(string(b), 64)
+		if errA == nil && errB == nil {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return bytes.Compare(a, b)
+}
+
+// unquoteJSON returns the contents of a JSON string, only decoding it when it has escapes
+func unquoteJSON(raw json.RawMessage) []byte {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return raw[1 : len(raw)-1]
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return raw
+	}
+	return []byte(str)
+}
+
+// compareUTF16 differs from comparing the UTF-8 bytes for characters past U+FFFF,
+// which UTF-16 puts before U+E000 to U+FFFF
+func compareUTF16(a, b []byte) int {
+	for len(a) > 0 && len(b) > 0 {
+		ra, na := utf8.DecodeRune(a)
+		rb, nb := utf8.DecodeRune(b)
+		if ra != rb {
+			a1, a2 := utf16Units(ra)
+			b1, b2 := utf16Units(rb)
+			if a1 != b1 {
+				return cmp.Compare(a1, b1)
+			}
+			return cmp.Compare(a2, b2)
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func utf16Units(r rune) (rune, rune) {
+	if r < 0x10000 {
+		return r, 0
+	}
+	return utf16.EncodeRune(r)
+}
+
+type jsonWriter struct {
+	*bufio.Writer
+	keys   map[string][]byte
+	pretty bool
+	indent bytes.Buffer
+	entry  bytes.Buffer
+}
+
+func (j *jsonWriter) writeEntry(fields []jsonField) error {
+
+	out := j.Writer
+	if j.pretty {
+		j.entry.Reset()
+		out = bufio.NewWriter(&j.entry)
+	}
+
+	out.WriteByte('{')
+	first := true
+	for _, field := range fields {
+		if field.omit {
+			continue
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		key, ok := j.keys[field.key]
+		if !ok {
+			key, _ = json.Marshal(field.key)
+			j.keys[field.key] = key
+		}
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(field.value)
+	}
+	out.WriteByte('}')
+
+	if j.pretty {
+		out.Flush()
+		j.indent.Reset()
+		if err := json.Indent(&j.indent, j.entry.Bytes(), "  ", "  "); err != nil {
+			return err
+		}
+		j.Writer.WriteString("\n  ")
+		j.Writer.Write(j.indent.Bytes())
+	}
+
+	return nil
+}
+
+// StreamTorrentsInfo fans torrents/info out to every instance and writes the
+// merged list to w, recording hash ownership once every list was read through.
+// Errors after part of the list was written wrap ErrStreamCut, w then holds
+// invalid JSON and must not be passed on as a success.
+func (m *Multiplexer) StreamTorrentsInfo(w io.Writer, r *http.Request) error {
+
+	sortKey := r.Form.Get("sort")
+	if sortKey == "" {
+		sortKey = "added_on"
+	}
+	reverse, _ := strconv.ParseBool(r.Form.Get("reverse"))
+	offset, _ := strconv.Atoi(r.Form.Get("offset"))
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+
+	complete := true
+	for _, key := range torrentsInfoPartialKeys {
+		if r.Form.Has(key) {
+			complete = false
+		}
+	}
+
+	// Every instance sorts its own list, so only a merge is left to do here
+	query := url.Values{}
+	for k, v := range r.Form {
+		query[k] = v
+	}
+	query.Set("sort", sortKey)
+	query.Del("offset")
+	if offset < 0 {
+		offset = 0
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(offset+limit))
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, "/api/v2/torrents/info?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = r.Header.Clone()
+
+	resps := m.ParallelResponses(req, RequestOptions{})
+
+	defer func() {
+		for _, resp := range resps {
+			if resp.response != nil {
+				resp.response.Body.Close()
+			}
+		}
+	}()
+
+	for _, resp := range resps {
+		if len(resp.errs) != 0 {
+			err = errors.Join(append(resp.errs, err)...)
+		} else if resp.response.StatusCode != http.StatusOK {
+			err = errors.Join(err, errors.New("("+resp.instance.Host()+") torrents/info - Status Code: "+strconv.Itoa(resp.response.StatusCode)))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	streams := []*torrentStream{}
+	for _, resp := range resps {
+		s, err := newTorrentStream(resp.instance, resp.response.Body)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, s)
+	}
+
+	remove := map[string]bool{}
+	for _, key := range m.Config.Format.Info.RemoveFields {
+		if key != "" {
+			remove[key] = true
+		}
+	}
+
+	// Prime every stream with its first element
+	active := []*torrentStream{}
+	for _, s := range streams {
+		ok, err := s.next(sortKey, remove)
+		if err != nil {
+			return err
+		}
+		if ok {
+			active = append(active, s)
+		}
+	}
+
+	counter := &countingWriter{Writer: w}
+	out := &jsonWriter{
+		Writer: bufio.NewWriterSize(counter, 64*1024),
+		keys:   map[string][]byte{},
+		pretty: m.Config.Format.PrettyPrint,
+	}
+	out.WriteByte('[')
+
+	written := 0
+	for n := 0; len(active) > 0; n++ {
+
+		// Ties keep instance order, so the output is stable
+		pick := 0
+		for idx := 1; idx < len(active); idx++ {
+			cmp := compareJSON(active[idx].sortValue(), active[pick].sortValue())
+			if (!reverse && cmp < 0) || (reverse && cmp > 0) {
+				pick = idx
+			}
+		}
+		s := active[pick]
+
+		if n >= offset && (limit <= 0 || written < limit) {
+			if written > 0 {
+				out.WriteByte(',')
+			}
+			if err := out.writeEntry(s.fields); err != nil {
+				return streamCut(counter, err)
+			}
+			written += 1
+		}
+
+		ok, err := s.next(sortKey, remove)
+		if err != nil {
+			return streamCut(counter, err)
+		}
+		if !ok {
+			active = append(active[:pick], active[pick+1:]...)
+		}
+	}
+
+	if out.pretty && written > 0 {
+		out.WriteByte('\n')
+	}
+	out.WriteByte(']')
+
+	for _, s := range streams {
+		m.Pool.SetTorrents(s.instance, s.hashes, complete)
+	}
+
+	if err := out.Flush(); err != nil {
+		return streamCut(counter, err)
+	}
+
+	return nil
+
+}
+
+// streamCut wraps err in ErrStreamCut once something was written
+func streamCut(counter *countingWriter, err error) error {
+	if counter.n == 0 {
+		return err
+	}
+	return errors.Join(ErrStreamCut, err)
+}
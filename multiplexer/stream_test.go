@@ -0,0 +1,151 @@
+package multiplexer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/W-Floyd/qbittorrent-multiplexer/qbittorrent"
+)
+
+func TestCompareJSON(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{`1`, `2`, -1},
+		{`10`, `9`, 1},
+		{`1.5`, `1.50`, 0},
+		{`false`, `true`, -1},
+		{`"abc"`, `"abd"`, -1},
+		{`"ab"`, `"a"`, 1},
+		{`"B"`, `"a"`, -1},
+		{`"\u00e9"`, `"é"`, 0},
+		{`"a\"b"`, `"a#"`, -1},
+		{`"\ud83d\ude00"`, `"\uffff"`, -1}, // UTF-16 puts characters past U+FFFF first
+		{`"😀"`, `"\ufffd"`, -1},
+	}
+	for _, test := range tests {
+		if got := compareJSON(json.RawMessage(test.a), json.RawMessage(test.b)); got != test.want {
+			t.Errorf("compareJSON(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// benchmarkTorrents returns a sorted torrents/info body with count torrents,
+// added_on interleaved with the other instances
+func benchmarkTorrents(instance, instances, count int) []byte {
+	torrents := make([]map[string]interface{}, count)
+	for n := range torrents {
+		hash := strconv.Itoa(instance) + "-" + strconv.Itoa(n)
+		torrents[n] = map[string]interface{}{
+			"hash":           strings.Repeat("0", 40-len(hash)) + hash,
+			"name":           "Some.Linux.Distribution." + hash + ".iso",
+			"added_on":       n*instances + instance,
+			"amount_left":    0,
+			"category":       "linux",
+			"completed":      4294967296,
+			"dlspeed":        0,
+			"downloaded":     4294967296,
+			"eta":            8640000,
+			"num_leechs":     3,
+			"num_seeds":      12,
+			"progress":       1,
+			"ratio":          2.5,
+			"save_path":      "/downloads/linux",
+			"size":           4294967296,
+			"state":          "stalledUP",
+			"tags":           "iso, linux",
+			"total_size":     4294967296,
+			"tracker":        "udp://tracker.example.org:1337/announce",
+			"upspeed":        10240,
+			"uploaded":       10737418240,
+			"time_active":    123456,
+			"seeding_time":   120000,
+			"last_activity":  1700000000,
+			"content_path":   "/downloads/linux/Some.Linux.Distribution." + hash + ".iso",
+			"auto_tmm":       false,
+			"force_start":    false,
+			"super_seeding":  false,
+			"seq_dl":         false,
+			"f_l_piece_prio": false,
+		}
+	}
+	b, _ := json.Marshal(torrents)
+	return b
+}
+
+func benchmarkMultiplexer(b *testing.B) *Multiplexer {
+	const instances, torrents = 4, 5000
+
+	servers := []*httptest.Server{}
+	for n := range instances {
+		body := benchmarkTorrents(n, instances, torrents)
+		servers = append(servers, fakeInstance(b, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}))
+	}
+
+	return newTestMultiplexer(b, Config{}, servers...)
+}
+
+func torrentsInfoRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/torrents/info", nil)
+	r.ParseForm()
+	return r
+}
+
+func BenchmarkStreamTorrentsInfo(b *testing.B) {
+	m := benchmarkMultiplexer(b)
+	r := torrentsInfoRequest()
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := m.StreamTorrentsInfo(io.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The gabs merge torrents/info went through before it was streamed
+func BenchmarkMergeTorrentsInfoGabs(b *testing.B) {
+	m := benchmarkMultiplexer(b)
+	r := torrentsInfoRequest()
+
+	callback := func(m *Multiplexer, resp *http.Response) error {
+		body, err := ResponseBody(resp)
+		if err != nil {
+			return err
+		}
+		cont, err := gabs.ParseJSON(body)
+		if err != nil {
+			return err
+		}
+		instance := resp.Request.Context().Value(qbittorrent.ContextKeyInstance).(*qbittorrent.Instance)
+		for _, child := range cont.Children() {
+			hash := qbittorrent.Hash(strings.ReplaceAll(child.Search("hash").String(), "\"", ""))
+			if hash == "" {
+				return errors.New("no hash found for child")
+			}
+			m.Pool.SetTorrent(hash, instance)
+		}
+		return nil
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		resp, err := m.HandlerMergeJSON(r, RequestOptions{Callback: &callback}, MergeOptions{
+			RootIsArray: true,
+			ArraySortFn: SortRootGabsArrayByKey(m, "added_on"),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+	}
+}
@@ -0,0 +1,290 @@
+package qbittorrent
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrForbidden = errors.New("forbidden")
+	ErrNotFound  = errors.New("not found")
+)
+
+// StatusError is returned when an instance answers with a non-200 status
+type StatusError struct {
+	Instance   string
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return "(" + e.Instance + ") " + e.Method + " " + e.Path + " - Status Code: " + strconv.Itoa(e.StatusCode) + " - Body: " + e.Body
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Do prepares the request for this instance and sends it
+func (i *Instance) Do(r *http.Request) (*http.Response, error) {
+	return i.Send(i.PrepareRequest(r))
+}
+
+func (i *Instance) call(method, path string, form url.Values) (*http.Response, error) {
+
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else if form != nil {
+		req.URL.RawQuery = form.Encode()
+	}
+
+	resp, err := i.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{
+			Instance:   i.Host(),
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	return resp, nil
+
+}
+
+func (i *Instance) getJSON(path string, query url.Values, v interface{}) error {
+	resp, err := i.call(http.MethodGet, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.New("(" + i.Host() + ") decoding " + path + ": " + err.Error())
+	}
+	return nil
+}
+
+func (i *Instance) post(path string, form url.Values) error {
+	resp, err := i.call(http.MethodPost, path, form)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func JoinHashes(hashes []Hash) string {
+	s := make([]string, len(hashes))
+	for n, hash := range hashes {
+		s[n] = string(hash)
+	}
+	return strings.Join(s, "|")
+}
+
+func (i *Instance) Version() (string, error) {
+	resp, err := i.call(http.MethodGet, "/api/v2/app/version", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func (i *Instance) Preferences() (p Preferences, err error) {
+	err = i.getJSON("/api/v2/app/preferences", nil, &p)
+	return
+}
+
+func (i *Instance) SetPreferences(p Preferences) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return i.post("/api/v2/app/setPreferences", url.Values{"json": {string(b)}})
+}
+
+// Torrents accepts the torrents/info parameters (filter, category, tag, sort, hashes...)
+func (i *Instance) Torrents(query url.Values) (t []Torrent, err error) {
+	err = i.getJSON("/api/v2/torrents/info", query, &t)
+	return
+}
+
+func (i *Instance) Trackers(hash Hash) (t []Tracker, err error) {
+	err = i.getJSON("/api/v2/torrents/trackers", url.Values{"hash": {string(hash)}}, &t)
+	return
+}
+
+func (i *Instance) Categories() (c map[string]Category, err error) {
+	err = i.getJSON("/api/v2/torrents/categories", nil, &c)
+	return
+}
+
+func (i *Instance) Delete(hashes []Hash, deleteFiles bool) error {
+	return i.post("/api/v2/torrents/delete", url.Values{
+		"hashes":      {JoinHashes(hashes)},
+		"deleteFiles": {strconv.FormatBool(deleteFiles)},
+	})
+}
+
+func (i *Instance) MainData(rid int64) (m *MainData, err error) {
+	err = i.getJSON("/api/v2/sync/maindata", url.Values{"rid": {strconv.FormatInt(rid, 10)}}, &m)
+	return
+}
+
+// Limits are in bytes/s, 0 is unlimited
+func (i *Instance) SetDownloadLimit(limit int64) error {
+	return i.post("/api/v2/transfer/setDownloadLimit", url.Values{"limit": {strconv.FormatInt(limit, 10)}})
+}
+
+func (i *Instance) SetUploadLimit(limit int64) error {
+	return i.post("/api/v2/transfer/setUploadLimit", url.Values{"limit": {strconv.FormatInt(limit, 10)}})
+}
+
+// MainLog returns entries of every type newer than lastKnownID, -1 for all
+func (i *Instance) MainLog(lastKnownID int64) (l []LogEntry, err error) {
+	err = i.getJSON("/api/v2/log/main", url.Values{
+		"normal":        {"true"},
+		"info":          {"true"},
+		"warning":       {"true"},
+		"critical":      {"true"},
+		"last_known_id": {strconv.FormatInt(lastKnownID, 10)},
+	}, &l)
+	return
+}
+
+func (i *Instance) PeerLog(lastKnownID int64) (l []LogEntry, err error) {
+	err = i.getJSON("/api/v2/log/peers", url.Values{"last_known_id": {strconv.FormatInt(lastKnownID, 10)}}, &l)
+	return
+}
+
+// SpeedLimitsMode is true while the alternative speed limits are on
+func (i *Instance) SpeedLimitsMode() (bool, error) {
+	resp, err := i.call(http.MethodGet, "/api/v2/transfer/speedLimitsMode", nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(body)) == "1", nil
+}
+
+func (i *Instance) ToggleSpeedLimitsMode() error {
+	return i.post("/api/v2/transfer/toggleSpeedLimitsMode", nil)
+}
+
+// SetSpeedLimitsMode only toggles when needed, older versions have no way to
+// set it directly. The state is read again after toggling, in case it was
+// changed on the instance in between.
+func (i *Instance) SetSpeedLimitsMode(enabled bool) error {
+
+	i.speedLimitsMode.Lock()
+	defer i.speedLimitsMode.Unlock()
+
+	for toggles := 0; ; toggles++ {
+		current, err := i.SpeedLimitsMode()
+		if err != nil {
+			return err
+		}
+		if current == enabled {
+			return nil
+		}
+		if toggles == 2 {
+			return errors.New("(" + i.Host() + ") alternative speed limits keep changing, left " + strconv.FormatBool(current))
+		}
+		if err := i.ToggleSpeedLimitsMode(); err != nil {
+			return err
+		}
+	}
+
+}
+
+func (i *Instance) TransferInfo() (t *TransferInfo, err error) {
+	err = i.getJSON("/api/v2/transfer/info", nil, &t)
+	return
+}
+
+// SearchStart starts a search job and returns its id
+func (i *Instance) SearchStart(pattern, plugins, category string) (int64, error) {
+	resp, err := i.call(http.MethodPost, "/api/v2/search/start", url.Values{
+		"pattern":  {pattern},
+		"plugins":  {plugins},
+		"category": {category},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	job := struct {
+		ID int64 `json:"id"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		return 0, errors.New("(" + i.Host() + ") decoding /api/v2/search/start: " + err.Error())
+	}
+	return job.ID, nil
+}
+
+func (i *Instance) SearchStop(id int64) error {
+	return i.post("/api/v2/search/stop", url.Values{"id": {strconv.FormatInt(id, 10)}})
+}
+
+func (i *Instance) SearchDelete(id int64) error {
+	return i.post("/api/v2/search/delete", url.Values{"id": {strconv.FormatInt(id, 10)}})
+}
+
+func (i *Instance) SearchStatus(id int64) (s []SearchStatus, err error) {
+	err = i.getJSON("/api/v2/search/status", url.Values{"id": {strconv.FormatInt(id, 10)}}, &s)
+	return
+}
+
+// SearchResults returns the results of the job from offset on
+func (i *Instance) SearchResults(id int64, offset int) (s *SearchResults, err error) {
+	err = i.getJSON("/api/v2/search/results", url.Values{
+		"id":     {strconv.FormatInt(id, 10)},
+		"offset": {strconv.Itoa(offset)},
+	}, &s)
+	return
+}
+
+// AddURLs adds torrents from URLs or magnet links, options are any other torrents/add fields
+func (i *Instance) AddURLs(urls []string, options url.Values) error {
+	form := url.Values{"urls": {strings.Join(urls, "\n")}}
+	for key, value := range options {
+		form[key] = value
+	}
+	return i.post("/api/v2/torrents/add", form)
+}
@@ -0,0 +1,140 @@
+package qbittorrent
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// testInstance points an instance without authentication at handler
+func testInstance(t testing.TB, handler http.HandlerFunc) *Instance {
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	i, errs := (&Config{URL: s.URL}).New()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	return i
+}
+
+func TestClientDecoding(t *testing.T) {
+
+	i := testInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/app/version":
+			io.WriteString(w, "v4.6.0")
+		case "/api/v2/torrents/info":
+			if r.URL.Query().Get("category") != "linux" {
+				io.WriteString(w, "[]")
+				return
+			}
+			io.WriteString(w, `[{"hash":"abc","name":"debian.iso","size":1024,"progress":0.5,"tags":"a,b","unknown_field":1}]`)
+		case "/api/v2/transfer/info":
+			io.WriteString(w, `{"dl_info_speed":100,"up_info_speed":50,"dl_rate_limit":0,"connection_status":"connected"}`)
+		case "/api/v2/transfer/speedLimitsMode":
+			io.WriteString(w, "1\n")
+		case "/api/v2/sync/maindata":
+			io.WriteString(w, `{"rid":7,"full_update":false,"torrents":{"abc":{"dlspeed":10}},"torrents_removed":["def"],"server_state":{"dl_info_speed":10,"alltime_dl":20}}`)
+		case "/api/v2/search/start":
+			if r.Method != http.MethodPost || r.FormValue("pattern") != "debian" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"id":12}`)
+		case "/api/v2/torrents/categories":
+			io.WriteString(w, `{"linux":{"name":"linux","savePath":"/data/linux"}}`)
+		case "/api/v2/app/preferences":
+			io.WriteString(w, `not json`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	version, err := i.Version()
+	if err != nil || version != "v4.6.0" {
+		t.Errorf("Version: got %q, %v", version, err)
+	}
+
+	torrents, err := i.Torrents(url.Values{"category": {"linux"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 || torrents[0].Hash != "abc" || torrents[0].Size != 1024 || torrents[0].Progress != 0.5 || torrents[0].Tags != "a,b" {
+		t.Errorf("Torrents: got %+v", torrents)
+	}
+
+	info, err := i.TransferInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DlInfoSpeed != 100 || info.UpInfoSpeed != 50 || info.ConnectionStatus != "connected" {
+		t.Errorf("TransferInfo: got %+v", info)
+	}
+
+	if enabled, err := i.SpeedLimitsMode(); err != nil || !enabled {
+		t.Errorf("SpeedLimitsMode: got %v, %v", enabled, err)
+	}
+
+	data, err := i.MainData(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.RID != 7 || data.FullUpdate || data.Torrents["abc"].DlSpeed != 10 || len(data.TorrentsRemoved) != 1 ||
+		data.ServerState.DlInfoSpeed != 10 || data.ServerState.AlltimeDl != 20 {
+		t.Errorf("MainData: got %+v", data)
+	}
+
+	if id, err := i.SearchStart("debian", "all", "all"); err != nil || id != 12 {
+		t.Errorf("SearchStart: got %d, %v", id, err)
+	}
+
+	categories, err := i.Categories()
+	if err != nil || categories["linux"].SavePath != "/data/linux" {
+		t.Errorf("Categories: got %+v, %v", categories, err)
+	}
+
+	if _, err := i.Preferences(); err == nil {
+		t.Error("Preferences: decoding garbage should fail")
+	}
+
+	_, err = i.Trackers("abc")
+	status := &StatusError{}
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &status) || status.Path != "/api/v2/torrents/trackers" {
+		t.Errorf("Trackers: got %v, want a not found status error", err)
+	}
+
+}
+
+func TestSetSpeedLimitsModeChecksAgain(t *testing.T) {
+
+	mode := atomic.Bool{}
+	reads := atomic.Int64{}
+	i := testInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/transfer/speedLimitsMode":
+			if mode.Load() {
+				io.WriteString(w, "1")
+			} else {
+				io.WriteString(w, "0")
+			}
+			// Someone turns them on in the WebUI right after the first read
+			if reads.Add(1) == 1 {
+				mode.Store(true)
+			}
+		case "/api/v2/transfer/toggleSpeedLimitsMode":
+			mode.Store(!mode.Load())
+		}
+	})
+
+	if err := i.SetSpeedLimitsMode(true); err != nil {
+		t.Fatal(err)
+	}
+	if !mode.Load() {
+		t.Error("the toggle turned the limits off")
+	}
+
+}
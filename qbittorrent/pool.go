@@ -0,0 +1,255 @@
+package qbittorrent
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool is a set of instances along with which instance owns each torrent
+type Pool struct {
+	Instances         []*Instance
+	Torrents          map[Hash]*Instance
+	RoundRobinCounter int
+
+	Locks struct {
+		Instances         sync.Mutex
+		Torrents          sync.Mutex
+		RoundRobinCounter sync.Mutex
+	}
+
+	ctx    context.Context // Done once the pool is closed
+	cancel context.CancelFunc
+}
+
+func NewPool(instances []*Instance) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		Instances: instances,
+		Torrents:  map[Hash]*Instance{},
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Close stops the pool's background work, retrying connections and
+// refreshing logins. Requests can still be sent, they log in as needed.
+func (p *Pool) Close() {
+	p.cancel()
+	for _, instance := range p.All() {
+		instance.stopRefresh()
+	}
+}
+
+// SetTorrents records the instance as owner of the hashes. When complete is
+// set the hashes are the full list, so anything else it owned is dropped.
+func (p *Pool) SetTorrents(instance *Instance, hashes []Hash, complete bool) {
+
+	p.Locks.Torrents.Lock()
+	defer p.Locks.Torrents.Unlock()
+
+	var seen map[Hash]bool
+	if complete {
+		seen = make(map[Hash]bool, len(hashes))
+	}
+
+	for _, hash := range hashes {
+		p.Torrents[hash] = instance
+		if complete {
+			seen[hash] = true
+		}
+	}
+
+	if complete {
+		for hash, owner := range p.Torrents {
+			if owner == instance && !seen[hash] {
+				delete(p.Torrents, hash)
+			}
+		}
+	}
+
+}
+
+// Connect logs in, checks the API answers and loads the instance's torrents
+// before marking it ready, so placement never sees it with an empty list
+func (p *Pool) Connect(i *Instance) error {
+
+	_, err := i.Version()
+	if err != nil {
+		return err
+	}
+
+	torrents, err := i.Torrents(nil)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]Hash, len(torrents))
+	for n, torrent := range torrents {
+		hashes[n] = torrent.Hash
+	}
+	p.SetTorrents(i, hashes, true)
+
+	i.ready.Store(true)
+	log.Println("Instance ready (" + i.Host() + ") - " + strconv.Itoa(len(hashes)) + " torrents")
+	return nil
+
+}
+
+// KeepConnecting retries Connect with a growing delay until it succeeds or
+// the pool is closed
+func (p *Pool) KeepConnecting(i *Instance) {
+	delay := time.Second
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := p.Connect(i)
+		if err == nil {
+			return
+		}
+		log.Println("Instance still pending (" + i.Host() + "): " + err.Error())
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+func (p *Pool) SetTorrent(hash Hash, instance *Instance) {
+	p.Locks.Torrents.Lock()
+	defer p.Locks.Torrents.Unlock()
+	p.Torrents[hash] = instance
+}
+
+func (p *Pool) LeastBusy() *Instance {
+	return p.LeastBusyAfter(nil)
+}
+
+// LeastBusyAfter also counts pending torrents, added to an instance but not
+// known by hash yet
+func (p *Pool) LeastBusyAfter(pending map[*Instance]int) *Instance {
+
+	counts := p.Counts()
+	for instance := range counts {
+		if !instance.Ready() || instance.Draining() {
+			delete(counts, instance)
+		} else {
+			counts[instance] += pending[instance]
+		}
+	}
+
+	var minimum *int
+
+	for _, c := range counts {
+		if minimum == nil {
+			minimum = &c
+		} else {
+			if c < *minimum {
+				minimum = &c
+			}
+		}
+	}
+
+	if minimum == nil {
+		return nil
+	}
+
+	minimumInstances := []*Instance{}
+
+	for instance, count := range counts {
+		if count == *minimum {
+			minimumInstances = append(minimumInstances, instance)
+		}
+	}
+
+	slices.SortStableFunc(minimumInstances, func(a, b *Instance) int {
+		return strings.Compare(a.Host(), b.Host())
+	})
+
+	return minimumInstances[0]
+
+}
+
+// All returns a snapshot of the instances, safe to range over while config changes
+func (p *Pool) All() []*Instance {
+	p.Locks.Instances.Lock()
+	defer p.Locks.Instances.Unlock()
+	return slices.Clone(p.Instances)
+}
+
+// Ready returns a snapshot of the instances that can take requests
+func (p *Pool) Ready() (ready []*Instance) {
+	for _, instance := range p.All() {
+		if instance.Ready() {
+			ready = append(ready, instance)
+		}
+	}
+	return
+}
+
+// Counts returns how many known torrents each instance owns
+func (p *Pool) Counts() map[*Instance]int {
+
+	instances := p.All()
+
+	p.Locks.Torrents.Lock()
+	defer p.Locks.Torrents.Unlock()
+
+	counts := map[*Instance]int{}
+	for _, instance := range instances {
+		counts[instance] = 0
+	}
+	for _, instance := range p.Torrents {
+		if _, ok := counts[instance]; ok {
+			counts[instance] += 1
+		}
+	}
+
+	return counts
+
+}
+
+func (p *Pool) Owner(hash Hash) (*Instance, bool) {
+	p.Locks.Torrents.Lock()
+	defer p.Locks.Torrents.Unlock()
+	instance, ok := p.Torrents[hash]
+	return instance, ok
+}
+
+func (p *Pool) ByName(name string) *Instance {
+	p.Locks.Instances.Lock()
+	defer p.Locks.Instances.Unlock()
+	for _, instance := range p.Instances {
+		if instance.Name == name {
+			return instance
+		}
+	}
+	for _, instance := range p.Instances {
+		if instance.Name == "" && instance.Host() == name {
+			return instance
+		}
+	}
+	return nil
+}
+
+// NextRoundRobin skips instances that aren't ready or are draining
+func (p *Pool) NextRoundRobin() *Instance {
+	p.Locks.Instances.Lock()
+	defer p.Locks.Instances.Unlock()
+	p.Locks.RoundRobinCounter.Lock()
+	defer p.Locks.RoundRobinCounter.Unlock()
+	for range p.Instances {
+		p.RoundRobinCounter += 1
+		if p.RoundRobinCounter >= len(p.Instances) {
+			p.RoundRobinCounter = 0
+		}
+		if instance := p.Instances[p.RoundRobinCounter]; instance.Ready() && !instance.Draining() {
+			return p.Instances[p.RoundRobinCounter]
+		}
+	}
+	return nil
+}
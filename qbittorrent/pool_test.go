@@ -0,0 +1,183 @@
+package qbittorrent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPool(names ...string) *Pool {
+	instances := []*Instance{}
+	for _, name := range names {
+		i := &Instance{Name: name, URL: &url.URL{Scheme: "http", Host: name}}
+		i.ready.Store(true)
+		instances = append(instances, i)
+	}
+	return NewPool(instances)
+}
+
+// Run with go test -race, the pool is shared by every request
+func TestPoolConcurrent(t *testing.T) {
+
+	p := testPool("a", "b", "c")
+	instances := p.All()
+
+	const workers, hashes = 9, 50
+
+	picks := make([]map[*Instance]int, workers)
+	g := sync.WaitGroup{}
+	for n := range workers {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			picks[n] = map[*Instance]int{}
+			owned := []Hash{}
+			for h := range hashes {
+				owned = append(owned, Hash(strconv.Itoa(n)+"-"+strconv.Itoa(h)))
+				p.SetTorrents(instances[n%len(instances)], owned, false)
+				p.Counts()
+				picks[n][p.NextRoundRobin()] += 1
+			}
+		}()
+	}
+	g.Wait()
+
+	counts := p.Counts()
+	for _, i := range instances {
+		if want := workers / len(instances) * hashes; counts[i] != want {
+			t.Errorf("%s owns %d torrents, want %d", i.Name, counts[i], want)
+		}
+	}
+
+	total := map[*Instance]int{}
+	for _, worker := range picks {
+		for i, count := range worker {
+			total[i] += count
+		}
+	}
+	for _, i := range instances {
+		if want := workers * hashes / len(instances); total[i] != want {
+			t.Errorf("%s picked %d times by round robin, want %d", i.Name, total[i], want)
+		}
+	}
+
+}
+
+func TestPoolSetTorrents(t *testing.T) {
+
+	p := testPool("a", "b")
+	a, b := p.All()[0], p.All()[1]
+
+	p.SetTorrents(a, []Hash{"1", "2", "3"}, true)
+	p.SetTorrents(b, []Hash{"4"}, false)
+
+	// A complete list drops what the instance no longer has, and nothing of the others
+	p.SetTorrents(a, []Hash{"1"}, true)
+
+	tests := []struct {
+		hash  Hash
+		owner *Instance
+	}{
+		{"1", a},
+		{"2", nil},
+		{"3", nil},
+		{"4", b},
+	}
+	for _, test := range tests {
+		owner, _ := p.Owner(test.hash)
+		if owner != test.owner {
+			t.Errorf("owner of %s is %v, want %v", test.hash, owner, test.owner)
+		}
+	}
+
+}
+
+func TestNextRoundRobinSkipsUnavailable(t *testing.T) {
+
+	p := testPool("a", "b", "c")
+	a, b, c := p.All()[0], p.All()[1], p.All()[2]
+	b.SetDraining(true)
+	c.ready.Store(false)
+
+	for range 5 {
+		if i := p.NextRoundRobin(); i != a {
+			t.Fatalf("round robin picked %v, want a", i)
+		}
+	}
+
+	a.SetDraining(true)
+	if i := p.NextRoundRobin(); i != nil {
+		t.Errorf("round robin picked %s with nothing available", i.Name)
+	}
+
+}
+
+func TestPendingInstanceBecomesReady(t *testing.T) {
+
+	up := atomic.Bool{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !up.Load():
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		case r.URL.Path == "/api/v2/app/version":
+			io.WriteString(w, "v4.6.0")
+		case r.URL.Path == "/api/v2/torrents/info":
+			io.WriteString(w, `[{"hash":"x"},{"hash":"y"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	running := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/app/version" {
+			io.WriteString(w, "v4.6.0")
+			return
+		}
+		io.WriteString(w, "[]")
+	}))
+	defer running.Close()
+
+	// An unreachable instance isn't a config error
+	p, errs := Configs{{URL: running.URL, Name: "running"}, {URL: s.URL, Name: "late"}}.NewPool()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	defer p.Close()
+	late := p.ByName("late")
+
+	if late.Ready() || len(p.Ready()) != 1 {
+		t.Fatal("an instance that doesn't answer is ready")
+	}
+	for range 5 {
+		if i := p.LeastBusy(); i != p.ByName("running") {
+			t.Fatalf("placed on %v while pending", i)
+		}
+	}
+
+	up.Store(true)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !late.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("instance still pending after it came up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Its torrents are known by the time it can be picked
+	for _, hash := range []Hash{"x", "y"} {
+		if owner, _ := p.Owner(hash); owner != late {
+			t.Errorf("owner of %s is %v once ready, want late", hash, owner)
+		}
+	}
+	if i := p.LeastBusy(); i != p.ByName("running") {
+		t.Errorf("placed on %v, want the instance without torrents", i.Name)
+	}
+
+}
@@ -0,0 +1,117 @@
+package qbittorrent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	DefaultTimeout = time.Minute
+	SchemeUnix     = "unix"
+)
+
+type TransportConfig struct {
+	Timeout time.Duration `usage:"Timeout for a whole request to the instance, negative to disable (default 1m)"`
+	Proxy   string        `usage:"HTTP or SOCKS5 proxy for the instance (http://host:port, socks5://host:port)"`
+	TLS     struct {
+		CA                 string `usage:"PEM file of extra CA certificates to trust"`
+		Cert               string `usage:"PEM file of the client certificate"`
+		Key                string `usage:"PEM file of the client certificate key"`
+		InsecureSkipVerify bool   `usage:"Don't verify the instance's certificate"`
+	}
+	MaxIdleConns    int           `usage:"Idle connections kept open to the instance (default 2)"`
+	MaxConns        int           `usage:"Limit on connections to the instance, 0 for none"`
+	IdleConnTimeout time.Duration `usage:"How long idle connections are kept open (default 90s)"`
+}
+
+// NewClient builds the http client for the instance, socket is only set for unix:// URLs
+func (c *TransportConfig) NewClient(socket string) (client *http.Client, errs []error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// TLS
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if c.TLS.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.TLS.CA)
+		if err != nil {
+			errs = append(errs, err)
+		} else if !pool.AppendCertsFromPEM(pem) {
+			errs = append(errs, errors.New("no certificates found in "+c.TLS.CA))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.TLS.Cert != "" || c.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// Proxy
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h":
+				transport.Proxy = http.ProxyURL(u)
+			default:
+				errs = append(errs, errors.New("unsupported proxy scheme: "+u.Scheme))
+			}
+		}
+	}
+
+	// Unix socket
+	if socket != "" {
+		if c.Proxy != "" {
+			errs = append(errs, errors.New("a proxy can't be used with a unix socket"))
+		}
+		transport.Proxy = nil
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	// Connection pool
+	if c.MaxIdleConns != 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConns
+		transport.MaxIdleConns = max(transport.MaxIdleConns, c.MaxIdleConns)
+	}
+	if c.MaxConns != 0 {
+		transport.MaxConnsPerHost = c.MaxConns
+	}
+	if c.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = c.IdleConnTimeout
+	}
+
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}
+	if c.Timeout == 0 {
+		client.Timeout = DefaultTimeout
+	} else if c.Timeout < 0 {
+		client.Timeout = 0
+	}
+
+	return
+
+}
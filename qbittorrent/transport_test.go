@@ -0,0 +1,166 @@
+package qbittorrent
+
+import (
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "v4.6.0")
+}
+
+func TestTransportUnixSocket(t *testing.T) {
+
+	socket := filepath.Join(t.TempDir(), "qbittorrent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(versionHandler))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	i, errs := (&Config{URL: "unix://" + socket}).New()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if i.Host() != socket || i.String() != "unix://"+socket {
+		t.Errorf("socket instance goes by %s and %s", i.Host(), i.String())
+	}
+	if version, err := i.Version(); err != nil || version != "v4.6.0" {
+		t.Errorf("got %q, %v over the socket", version, err)
+	}
+
+}
+
+func TestTransportTLS(t *testing.T) {
+
+	s := httptest.NewTLSServer(http.HandlerFunc(versionHandler))
+	defer s.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		ok     bool
+	}{
+		{"unknown certificate", func(c *Config) {}, false},
+		{"extra CA", func(c *Config) { c.Transport.TLS.CA = ca }, true},
+		{"skip verify", func(c *Config) { c.Transport.TLS.InsecureSkipVerify = true }, true},
+	}
+
+	for _, test := range tests {
+		config := &Config{URL: s.URL}
+		test.config(config)
+		i, errs := config.New()
+		if len(errs) != 0 {
+			t.Errorf("%s: %v", test.name, errs)
+			continue
+		}
+		_, err := i.Version()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want success %v", test.name, err, test.ok)
+		}
+	}
+
+}
+
+func TestTransportTimeout(t *testing.T) {
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		versionHandler(w, r)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{50 * time.Millisecond, false},
+		{-1, true}, // Disabled
+		{0, true},  // The default minute
+	}
+
+	for _, test := range tests {
+		config := &Config{URL: s.URL}
+		config.Transport.Timeout = test.timeout
+		i, errs := config.New()
+		if len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		_, err := i.Version()
+		if (err == nil) != test.ok {
+			t.Errorf("timeout %s: got error %v, want success %v", test.timeout, err, test.ok)
+		}
+	}
+
+}
+
+func TestTransportProxy(t *testing.T) {
+
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		versionHandler(w, r)
+	}))
+	defer proxy.Close()
+
+	config := &Config{URL: "http://qbittorrent.invalid:8080/base"}
+	config.Transport.Proxy = proxy.URL
+	i, errs := config.New()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if version, err := i.Version(); err != nil || version != "v4.6.0" {
+		t.Errorf("got %q, %v through the proxy", version, err)
+	}
+	if proxied != "http://qbittorrent.invalid:8080/base/api/v2/app/version" {
+		t.Errorf("proxy was asked for %q", proxied)
+	}
+
+}
+
+func TestTransportConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		want   string
+	}{
+		{"proxy scheme", func(c *Config) { c.Transport.Proxy = "ftp://proxy:21" }, "unsupported proxy scheme"},
+		{"proxy with socket", func(c *Config) { c.URL = "unix:///tmp/qbittorrent.sock"; c.Transport.Proxy = "http://proxy:3128" }, "unix socket"},
+		{"socket without path", func(c *Config) { c.URL = "unix://" }, "socket path"},
+		{"missing CA", func(c *Config) { c.Transport.TLS.CA = "/nonexistent/ca.pem" }, "no such file"},
+		{"key without cert", func(c *Config) { c.Transport.TLS.Key = "/nonexistent/key.pem" }, "no such file"},
+	}
+
+	for _, test := range tests {
+		config := &Config{URL: "http://localhost:8080"}
+		test.config(config)
+		_, errs := config.New()
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), test.want)
+		}
+		if !found {
+			t.Errorf("%s: got %v, want an error about %q", test.name, errs, test.want)
+		}
+	}
+
+}
@@ -0,0 +1,138 @@
+package qbittorrent
+
+// Types mirror the qBittorrent WebUI API v2 responses
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)
+
+type Torrent struct {
+	AddedOn            int64   `json:"added_on"`
+	AmountLeft         int64   `json:"amount_left"`
+	AutoTMM            bool    `json:"auto_tmm"`
+	Availability       float64 `json:"availability"`
+	Category           string  `json:"category"`
+	Completed          int64   `json:"completed"`
+	CompletionOn       int64   `json:"completion_on"`
+	ContentPath        string  `json:"content_path"`
+	DlLimit            int64   `json:"dl_limit"`
+	DlSpeed            int64   `json:"dlspeed"`
+	Downloaded         int64   `json:"downloaded"`
+	DownloadedSession  int64   `json:"downloaded_session"`
+	ETA                int64   `json:"eta"`
+	FirstLastPiecePrio bool    `json:"f_l_piece_prio"`
+	ForceStart         bool    `json:"force_start"`
+	Hash               Hash    `json:"hash"`
+	InfohashV1         string  `json:"infohash_v1"`
+	InfohashV2         string  `json:"infohash_v2"`
+	LastActivity       int64   `json:"last_activity"`
+	MagnetURI          string  `json:"magnet_uri"`
+	MaxRatio           float64 `json:"max_ratio"`
+	MaxSeedingTime     int64   `json:"max_seeding_time"`
+	Name               string  `json:"name"`
+	NumComplete        int64   `json:"num_complete"`
+	NumIncomplete      int64   `json:"num_incomplete"`
+	NumLeechs          int64   `json:"num_leechs"`
+	NumSeeds           int64   `json:"num_seeds"`
+	Priority           int64   `json:"priority"`
+	Progress           float64 `json:"progress"`
+	Ratio              float64 `json:"ratio"`
+	RatioLimit         float64 `json:"ratio_limit"`
+	SavePath           string  `json:"save_path"`
+	SeedingTime        int64   `json:"seeding_time"`
+	SeedingTimeLimit   int64   `json:"seeding_time_limit"`
+	SeenComplete       int64   `json:"seen_complete"`
+	SeqDl              bool    `json:"seq_dl"`
+	Size               int64   `json:"size"`
+	State              string  `json:"state"`
+	SuperSeeding       bool    `json:"super_seeding"`
+	Tags               string  `json:"tags"`
+	TimeActive         int64   `json:"time_active"`
+	TotalSize          int64   `json:"total_size"`
+	Tracker            string  `json:"tracker"`
+	TrackersCount      int64   `json:"trackers_count"`
+	UpLimit            int64   `json:"up_limit"`
+	Uploaded           int64   `json:"uploaded"`
+	UploadedSession    int64   `json:"uploaded_session"`
+	UpSpeed            int64   `json:"upspeed"`
+}
+
+type TransferInfo struct {
+	DlInfoSpeed      int64  `json:"dl_info_speed"`
+	DlInfoData       int64  `json:"dl_info_data"`
+	UpInfoSpeed      int64  `json:"up_info_speed"`
+	UpInfoData       int64  `json:"up_info_data"`
+	DlRateLimit      int64  `json:"dl_rate_limit"`
+	UpRateLimit      int64  `json:"up_rate_limit"`
+	DHTNodes         int64  `json:"dht_nodes"`
+	ConnectionStatus string `json:"connection_status"`
+}
+
+type ServerState struct {
+	TransferInfo
+	AlltimeDl            int64   `json:"alltime_dl"`
+	AlltimeUl            int64   `json:"alltime_ul"`
+	FreeSpaceOnDisk      int64   `json:"free_space_on_disk"`
+	GlobalRatio          string  `json:"global_ratio"`
+	Queueing             bool    `json:"queueing"`
+	TotalPeerConnections int64   `json:"total_peer_connections"`
+	UseAltSpeedLimits    bool    `json:"use_alt_speed_limits"`
+	AverageTimeQueue     int64   `json:"average_time_queue"`
+	ReadCacheHits        string  `json:"read_cache_hits"`
+	WriteCacheOverload   string  `json:"write_cache_overload"`
+	TotalBuffersSize     int64   `json:"total_buffers_size"`
+	TotalQueuedSize      int64   `json:"total_queued_size"`
+	RefreshInterval      float64 `json:"refresh_interval"`
+}
+
+// Partial updates (FullUpdate false) only carry changed fields, the rest are left zero
+type MainData struct {
+	RID               int64               `json:"rid"`
+	FullUpdate        bool                `json:"full_update"`
+	Torrents          map[Hash]Torrent    `json:"torrents"`
+	TorrentsRemoved   []Hash              `json:"torrents_removed"`
+	Categories        map[string]Category `json:"categories"`
+	CategoriesRemoved []string            `json:"categories_removed"`
+	Tags              []string            `json:"tags"`
+	TagsRemoved       []string            `json:"tags_removed"`
+	ServerState       ServerState         `json:"server_state"`
+}
+
+type Category struct {
+	Name     string `json:"name"`
+	SavePath string `json:"savePath"`
+}
+
+type Tracker struct {
+	URL           string `json:"url"`
+	Status        int64  `json:"status"`
+	Tier          int64  `json:"tier"`
+	NumPeers      int64  `json:"num_peers"`
+	NumSeeds      int64  `json:"num_seeds"`
+	NumLeeches    int64  `json:"num_leeches"`
+	NumDownloaded int64  `json:"num_downloaded"`
+	Msg           string `json:"msg"`
+}
+
+// Preferences is kept as a map, the set of keys changes between qBittorrent versions
+type Preferences map[string]interface{}
+
+// LogEntry is kept as a map, main and peer log entries have different fields
+type LogEntry map[string]interface{}
+
+const (
+	SearchRunning = "Running"
+	SearchStopped = "Stopped"
+)
+
+type SearchStatus struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Total  int64  `json:"total"`
+}
+
+type SearchResults struct {
+	Results []SearchResult `json:"results"`
+	Status  string         `json:"status"`
+	Total   int64          `json:"total"`
+}
+
+// SearchResult is kept as a map, plugins can add their own fields
+type SearchResult map[string]interface{}
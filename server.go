@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const SchemeUnix = "unix://"
+
+type ServerConfig struct {
+	Listen            []string      `usage:"Addresses to listen on instead of Address and Port (host:port, [::]:port, unix:///path/to/socket)"`
+	BasePath          string        `usage:"Serve everything under this URL prefix (/qbit/)"`
+	ReadTimeout       time.Duration `default:"15s" usage:"Timeout for reading a whole request"`
+	ReadHeaderTimeout time.Duration `default:"5s" usage:"Timeout for reading request headers"`
+	WriteTimeout      time.Duration `default:"15s" usage:"Timeout for writing a response"`
+	IdleTimeout       time.Duration `default:"60s" usage:"How long idle keep-alive connections are kept open"`
+	H2C               bool          `usage:"Accept HTTP/2 without TLS"`
+	TLS               struct {
+		Cert string `usage:"PEM certificate file, enables HTTPS (reloaded when it changes)"`
+		Key  string `usage:"PEM key file"`
+	}
+}
+
+func (c ServerConfig) Validate() (errs []error) {
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("(Server) TLS needs both Cert and Key"))
+	}
+
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		errs = append(errs, errors.New("(Server) Base Path must start with /: "+c.BasePath))
+	}
+
+	for _, listen := range c.Listen {
+		errs = append(errs, validateListen(listen)...)
+	}
+
+	return
+
+}
+
+func validateListen(listen string) (errs []error) {
+	if strings.HasPrefix(listen, SchemeUnix) {
+		if strings.TrimPrefix(listen, SchemeUnix) == "" {
+			errs = append(errs, errors.New("(Server) Empty socket path: "+listen))
+		}
+		return
+	}
+	_, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		errs = append(errs, errors.New("(Server) Bad listen address: "+err.Error()))
+	}
+	return
+}
+
+// NewServer builds the server for one listen address
+func (c ServerConfig) NewServer(listen string, handler http.Handler) (srv *http.Server, err error) {
+
+	r := mux.NewRouter()
+	r.PathPrefix("/").Handler(handler)
+
+	srv = &http.Server{
+		Addr:              listen,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		Handler:           BasePath(c.BasePath, r),
+	}
+
+	// HTTP/2 is on by default over TLS
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(c.H2C)
+
+	if c.TLS.Cert != "" {
+		certs, err := NewCertReloader(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	return
+
+}
+
+// Serve listens on the server's address, tcp or unix socket, and blocks
+func Serve(srv *http.Server) error {
+
+	var l net.Listener
+	var err error
+
+	if strings.HasPrefix(srv.Addr, SchemeUnix) {
+		socket := strings.TrimPrefix(srv.Addr, SchemeUnix)
+		// A socket left over from an unclean shutdown is replaced, anything else is kept
+		if info, err := os.Lstat(socket); err == nil {
+			if info.Mode().Type() != os.ModeSocket {
+				return errors.New("not a socket, leaving it alone: " + socket)
+			}
+			if err := os.Remove(socket); err != nil {
+				return err
+			}
+		}
+		l, err = net.Listen("unix", socket)
+	} else {
+		l, err = net.Listen("tcp", srv.Addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Listening on " + srv.Addr)
+
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+
+}
+
+// BasePath serves h under prefix, redirects from instances are kept under it
+func BasePath(prefix string, h http.Handler) http.Handler {
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return h
+	}
+
+	stripped := http.StripPrefix(prefix, h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(&basePathWriter{ResponseWriter: w, prefix: prefix}, r)
+	})
+
+}
+
+type basePathWriter struct {
+	http.ResponseWriter
+	prefix string
+}
+
+func (w *basePathWriter) WriteHeader(statusCode int) {
+	location := w.Header().Get("Location")
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		w.Header().Set("Location", w.prefix+location)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *basePathWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CertReloader loads the certificate again whenever its files change
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	failed  time.Time // Files of the last failed reload, only logged once
+}
+
+func NewCertReloader(certFile, keyFile string) (c *CertReloader, err error) {
+	c = &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	_, err = c.GetCertificate(nil)
+	return
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	modTime := time.Time{}
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		// Keep serving the old one while the files are half written, and try
+		// again on the next handshake, finishing the write may not change mtime
+		if c.cert != nil {
+			if !modTime.Equal(c.failed) {
+				log.Println("Certificate reload failed: " + err.Error())
+				c.failed = modTime
+			}
+			return c.cert, nil
+		}
+		return nil, err
+	}
+
+	if c.cert != nil {
+		log.Println("Certificate reloaded")
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+
+	return c.cert, nil
+
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate with the serial number, and
+// sets both files to modTime
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		certFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for file, content := range files {
+		if err := os.WriteFile(file, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+func serial(t *testing.T, c *CertReloader) int64 {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Error("no error without certificate files")
+	}
+
+	writeCert(t, certFile, keyFile, 1, start)
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := serial(t, c); s != 1 {
+		t.Errorf("serving certificate %d, want 1", s)
+	}
+
+	writeCert(t, certFile, keyFile, 2, start.Add(time.Minute))
+	if s := serial(t, c); s != 2 {
+		t.Errorf("serving certificate %d after it changed, want 2", s)
+	}
+
+	// Half written, the last good one stays
+	halfWritten := start.Add(2 * time.Minute)
+	os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600)
+	os.Chtimes(certFile, halfWritten, halfWritten)
+	if s := serial(t, c); s != 2 {
+		t.Errorf("serving certificate %d while half written, want 2", s)
+	}
+
+	// Finishing the write within the same mtime is still picked up
+	writeCert(t, certFile, keyFile, 3, halfWritten)
+	if s := serial(t, c); s != 3 {
+		t.Errorf("serving certificate %d once written, want 3", s)
+	}
+
+	// Files going away keep the last good one too
+	os.Remove(keyFile)
+	if s := serial(t, c); s != 3 {
+		t.Errorf("serving certificate %d without files, want 3", s)
+	}
+
+}
+
+func TestBasePath(t *testing.T) {
+
+	h := BasePath("/qbit/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	tests := []struct {
+		path     string
+		status   int
+		body     string
+		location string
+	}{
+		{"/qbit/api/v2/app/version", http.StatusOK, "/api/v2/app/version", ""},
+		{"/qbit/", http.StatusOK, "/", ""},
+		{"/qbit", http.StatusMovedPermanently, "", "/qbit/"},
+		{"/qbit/login", http.StatusFound, "", "/qbit/"}, // Redirects stay under the base path
+		{"/qbitx/", http.StatusNotFound, "", ""},
+		{"/api/v2/app/version", http.StatusNotFound, "", ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, w.Code, test.status)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: got %q, want %q", test.path, w.Body.String(), test.body)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: redirected to %q, want %q", test.path, location, test.location)
+		}
+	}
+
+}
+
+func TestServeKeepsNonSocketFiles(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Serve(&http.Server{Addr: SchemeUnix + file})
+	if err == nil {
+		t.Fatal("served on top of a regular file")
+	}
+	if content, _ := os.ReadFile(file); string(content) != "data" {
+		t.Error("the file was replaced")
+	}
+
+}
+
+func TestServerConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config func(c *ServerConfig)
+		errs   int
+	}{
+		{"empty", func(c *ServerConfig) {}, 0},
+		{"listeners", func(c *ServerConfig) { c.Listen = []string{"127.0.0.1:9955", "[::]:9956", "unix:///run/qbit.sock"} }, 0},
+		{"no port", func(c *ServerConfig) { c.Listen = []string{"127.0.0.1"} }, 1},
+		{"empty socket", func(c *ServerConfig) { c.Listen = []string{"unix://"} }, 1},
+		{"cert without key", func(c *ServerConfig) { c.TLS.Cert = "cert.pem" }, 1},
+		{"relative base path", func(c *ServerConfig) { c.BasePath = "qbit/" }, 1},
+	}
+
+	for _, test := range tests {
+		c := ServerConfig{}
+		test.config(&c)
+		if errs := c.Validate(); len(errs) != test.errs {
+			t.Errorf("%s: got %v, want %d errors", test.name, errs, test.errs)
+		}
+	}
+
+}
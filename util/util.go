@@ -1,9 +1,11 @@
 package util
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"io"
+	"net/http"
 	"strconv"
 
 	"go.uber.org/zap"
@@ -22,3 +24,22 @@ func StringToRand(s string) string {
 	io.WriteString(h, s)
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// BufferBody reads the request body into memory and sets GetBody, so the
+// request can be cloned and sent any number of times
+func BufferBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+	b, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}